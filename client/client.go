@@ -141,7 +141,7 @@ func (host *Client) executeWithTimeout(req *Request, timeout time.Duration) (res
 }
 
 func (host *Client) Get(key string) (*Item, error) {
-	req := &Request{Cmd: "get", Key: key}
+	req := &Request{Cmd: "get", Keys: []string{key}}
 	resp, err := host.executeWithTimeout(req, ReadTimeout)
 	if err != nil {
 		return nil, err
@@ -150,8 +150,17 @@ func (host *Client) Get(key string) (*Item, error) {
 	return item, nil
 }
 
+func (host *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	req := &Request{Cmd: "get", Keys: keys}
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.items, nil
+}
+
 func (host *Client) store(cmd string, key string, item *Item, noreply bool) (bool, error) {
-	req := &Request{Cmd: cmd, Key: key, Item: item, NoReply: noreply}
+	req := &Request{Cmd: cmd, Keys: []string{key}, Item: item, NoReply: noreply}
 	resp, err := host.executeWithTimeout(req, WriteTimeout)
 	return err == nil && resp.status == "STORED", err
 }
@@ -166,7 +175,7 @@ func (host *Client) FlushAll() {
 }
 
 func (host *Client) Delete(key string) (bool, error) {
-	req := &Request{Cmd: "delete", Key: key}
+	req := &Request{Cmd: "delete", Keys: []string{key}}
 	resp, err := host.execute(req)
 	return err == nil && resp.status == "DELETED", err
 }
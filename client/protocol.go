@@ -3,6 +3,7 @@ package client
 import (
 	"bufio"
 	"caskdb/cmem"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -21,38 +23,67 @@ const (
 	MaxBodyLength = 1024 * 1024 * 50
 )
 
+// exptime up to 30 days is relative to now, as in memcached
+const MaxRelativeExptime = 60 * 60 * 24 * 30
+
+// keys of a page of scan
+const MaxScanLimit = 10000
+
 var AllocLimit = 1024 * 4
 
 type Item struct {
-	Body  []byte
-	alloc *byte
+	Body    []byte
+	Flag    int
+	Exptime int    // unix time, 0 means never, negative means expired
+	Cas     uint64 // cas unique, changed by every write
+	Deleted bool   // a tombstone, see Tombstoner
+	alloc   *byte
 }
 
 func (it *Item) String() (s string) {
-	return fmt.Sprintf("Item(Length:%d, Body:%v",
-		len(it.Body), it.Body)
+	return fmt.Sprintf("Item(Flag:%d, Exptime:%d, Cas:%d, Length:%d, Body:%v",
+		it.Flag, it.Exptime, it.Cas, len(it.Body), it.Body)
+}
+
+func (it *Item) Expired() bool {
+	return it.Exptime < 0 || (it.Exptime > 0 && int64(it.Exptime) <= time.Now().Unix())
+}
+
+// AbsExptime converts the exptime sent by clients into unix time.
+func AbsExptime(exptime int) int {
+	if exptime > 0 && exptime <= MaxRelativeExptime {
+		return int(time.Now().Unix()) + exptime
+	}
+	return exptime
 }
 
 type Request struct {
-	Cmd     string // get, set, delete, quit, etc.
-	Key     string // keys
+	Cmd     string   // get, set, delete, quit, etc.
+	Keys    []string // keys
 	Item    *Item
 	NoReply bool
+	// a write sent as "replicate addr,... cmd ..." is copied to Replicas
+	// by the server after it is applied
+	Replicas []string
+	// a write sent as "epoch n ..." is routed with the ring of epoch n
+	Epoch int64
 }
 
 func (req *Request) String() (s string) {
-	return fmt.Sprintf("Request(Cmd:%s, Key:%v, Item:%v, NoReply: %t)",
-		req.Cmd, req.Key, &req.Item, req.NoReply)
+	return fmt.Sprintf("Request(Cmd:%s, Keys:%v, Item:%v, NoReply: %t)",
+		req.Cmd, req.Keys, &req.Item, req.NoReply)
 }
 
 func (req *Request) Clear() {
 	req.NoReply = false
+	req.Replicas = nil
+	req.Epoch = 0
 	if req.Item != nil && req.Item.alloc != nil {
 		cmem.Free(req.Item.alloc, uintptr(cap(req.Item.Body)))
 		req.Item.Body = nil
 		req.Item.alloc = nil
-		req.Item = nil
 	}
+	req.Item = nil
 }
 
 func WriteFull(w io.Writer, buf []byte) error {
@@ -65,31 +96,65 @@ func WriteFull(w io.Writer, buf []byte) error {
 }
 
 func (req *Request) Write(w io.Writer) (e error) {
+	if req.Epoch > 0 {
+		io.WriteString(w, "epoch "+strconv.FormatInt(req.Epoch, 10)+" ")
+	}
+	if len(req.Replicas) > 0 {
+		io.WriteString(w, "replicate "+strings.Join(req.Replicas, ",")+" ")
+	}
 
 	switch req.Cmd {
 
-	case "get", "delete", "quit", "version", "stats", "flush_all":
+	case "get", "gets", "fetch", "delete", "quit", "version", "stats", "flush_all",
+		"migrate", "migrate_status", "merkle", "merkle_keys", "ring", "scan",
+		"delete_prefix", "delete_prefix_status", "reclaim":
 		io.WriteString(w, req.Cmd)
-		if req.Key != "" {
-			io.WriteString(w, " "+req.Key)
+		for _, key := range req.Keys {
+			io.WriteString(w, " "+key)
+		}
+		// a delete carrying a cas unique is the copy of a tombstone
+		if req.Cmd == "delete" && req.Item != nil && req.Item.Cas != 0 {
+			io.WriteString(w, " "+strconv.FormatUint(req.Item.Cas, 10))
 		}
 		if req.NoReply {
 			io.WriteString(w, " noreply")
 		}
 		_, e = io.WriteString(w, "\r\n")
 
-	case "set":
+	case "set", "add", "replace", "append", "prepend", "cas":
 		noreplay := ""
 		if req.NoReply {
 			noreplay = " noreply"
 		}
 		item := req.Item
-		fmt.Fprintf(w, "%s %s %d %s\r\n", req.Cmd, req.Key,
-			len(item.Body), noreplay)
+		// a set carrying a cas unique is a copy forwarded by a replica
+		cas := ""
+		if req.Cmd == "cas" || (req.Cmd == "set" && item.Cas != 0) {
+			cas = " " + strconv.FormatUint(item.Cas, 10)
+		}
+		fmt.Fprintf(w, "%s %s %d %d %d%s%s\r\n", req.Cmd, req.Keys[0],
+			item.Flag, item.Exptime, len(item.Body), cas, noreplay)
 		if WriteFull(w, item.Body) != nil {
 			return e
 		}
 		e = WriteFull(w, []byte("\r\n"))
+
+	case "incr", "decr":
+		noreplay := ""
+		if req.NoReply {
+			noreplay = " noreply"
+		}
+		_, e = fmt.Fprintf(w, "%s %s %s%s\r\n", req.Cmd, req.Keys[0],
+			req.Item.Body, noreplay)
+
+	case "touch":
+		noreplay := ""
+		if req.NoReply {
+			noreplay = " noreply"
+		}
+		_, e = fmt.Fprintf(w, "%s %s %d%s\r\n", req.Cmd, req.Keys[0],
+			req.Item.Exptime, noreplay)
+
 	default:
 		log.Printf("unkown request cmd:", req.Cmd)
 		return errors.New("unknown cmd: " + req.Cmd)
@@ -110,27 +175,70 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
 	if len(parts) < 1 {
 		return errors.New("invalid cmd")
 	}
+	if parts[0] == "epoch" {
+		if len(parts) < 3 {
+			return errors.New("invalid cmd")
+		}
+		if req.Epoch, e = strconv.ParseInt(parts[1], 10, 64); e != nil {
+			return e
+		}
+		parts = parts[2:]
+		if p := parts[0]; p != "replicate" && !isWrite(p) {
+			return errors.New("invalid cmd")
+		}
+	}
+	if parts[0] == "replicate" {
+		if len(parts) < 3 || !isWrite(parts[2]) {
+			return errors.New("invalid cmd")
+		}
+		req.Replicas = strings.Split(parts[1], ",")
+		parts = parts[2:]
+	}
 
 	req.Cmd = parts[0]
 	switch req.Cmd {
 
-	case "get":
-		if len(parts) != 2 {
+	case "get", "gets", "fetch":
+		if len(parts) < 2 {
 			return errors.New("invalid cmd")
 		}
-		req.Key = parts[1]
+		req.Keys = parts[1:]
 
-	case "set":
-		if len(parts) != 3 {
+	case "set", "add", "replace", "append", "prepend", "cas":
+		if parts[len(parts)-1] == "noreply" {
+			req.NoReply = true
+			parts = parts[:len(parts)-1]
+		}
+		// the cas unique of a cas, or of a set forwarded by a replica
+		n := 5
+		if req.Cmd == "cas" || req.Cmd == "set" && len(parts) == 6 {
+			n = 6
+		}
+		if len(parts) != n {
 			return errors.New("invalid cmd")
 		}
-		req.Key = parts[1]
+		req.Keys = parts[1:2]
 		req.Item = &Item{}
 		item := req.Item
-		length, e := strconv.Atoi(parts[2])
+		flag, e := strconv.ParseUint(parts[2], 10, 32)
 		if e != nil {
 			return e
 		}
+		item.Flag = int(flag)
+		exptime, e := strconv.Atoi(parts[3])
+		if e != nil {
+			return e
+		}
+		item.Exptime = AbsExptime(exptime)
+		length, e := strconv.Atoi(parts[4])
+		if e != nil {
+			return e
+		}
+		if len(parts) == 6 {
+			if item.Cas, e = strconv.ParseUint(parts[5], 10, 64); e != nil {
+				return e
+			}
+		}
 		if length > MaxBodyLength {
 			return errors.New("body too large")
 		}
@@ -156,11 +264,162 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
 		b.ReadByte() // \r
 		b.ReadByte() // \n
 
+	case "incr", "decr":
+		if len(parts) != 3 && len(parts) != 4 {
+			return errors.New("invalid cmd")
+		}
+		req.Keys = parts[1:2]
+		if _, e := strconv.ParseInt(parts[2], 10, 64); e != nil {
+			return errors.New("invalid numeric delta argument")
+		}
+		req.Item = &Item{Body: []byte(parts[2])}
+		if len(parts) == 4 {
+			if parts[3] != "noreply" {
+				return errors.New("invalid cmd")
+			}
+			req.NoReply = true
+		}
+
+	case "touch":
+		if len(parts) != 3 && len(parts) != 4 {
+			return errors.New("invalid cmd")
+		}
+		req.Keys = parts[1:2]
+		exptime, e := strconv.Atoi(parts[2])
+		if e != nil {
+			return e
+		}
+		req.Item = &Item{Exptime: AbsExptime(exptime)}
+		if len(parts) == 4 {
+			if parts[3] != "noreply" {
+				return errors.New("invalid cmd")
+			}
+			req.NoReply = true
+		}
+
 	case "delete":
+		if parts[len(parts)-1] == "noreply" {
+			req.NoReply = true
+			parts = parts[:len(parts)-1]
+		}
+		if len(parts) != 2 && len(parts) != 3 {
+			return errors.New("invalid cmd")
+		}
+		req.Keys = parts[1:2]
+		// the time of older clients is 0, a node copies a tombstone
+		// with its cas unique
+		if len(parts) == 3 {
+			cas, e := strconv.ParseUint(parts[2], 10, 64)
+			if e != nil {
+				return errors.New("invalid cmd")
+			}
+			if cas != 0 {
+				req.Item = &Item{Cas: cas, Deleted: true}
+			}
+		}
+
+	case "migrate":
+		// migrate addr left right [keyspace]
+		if len(parts) != 4 && len(parts) != 5 {
+			return errors.New("invalid cmd")
+		}
+		for _, p := range parts[2:4] {
+			if _, e := strconv.ParseUint(p, 10, 32); e != nil {
+				return e
+			}
+		}
+		if len(parts) == 5 {
+			if _, e := ParseKeyspace(parts[4]); e != nil {
+				return e
+			}
+		}
+		req.Keys = parts[1:]
+
+	case "migrate_status", "delete_prefix_status":
 		if len(parts) != 2 {
 			return errors.New("invalid cmd")
 		}
-		req.Key = parts[1]
+		req.Keys = parts[1:]
+
+	case "reclaim":
+		// reclaim cas [keyspace]
+		if len(parts) != 2 && len(parts) != 3 {
+			return errors.New("invalid cmd")
+		}
+		if cas, e := strconv.ParseUint(parts[1], 10, 64); e != nil || cas == 0 {
+			return errors.New("invalid cas")
+		}
+		if len(parts) == 3 {
+			if _, e := ParseKeyspace(parts[2]); e != nil {
+				return e
+			}
+		}
+		req.Keys = parts[1:]
+
+	case "delete_prefix":
+		// delete_prefix prefix cas [keyspace]
+		if len(parts) != 3 && len(parts) != 4 {
+			return errors.New("invalid cmd")
+		}
+		if len(parts[1]) > MaxKeyLength {
+			return errors.New("prefix too long")
+		}
+		if cas, e := strconv.ParseUint(parts[2], 10, 64); e != nil || cas == 0 {
+			return errors.New("invalid cas")
+		}
+		if len(parts) == 4 {
+			if _, e := ParseKeyspace(parts[3]); e != nil {
+				return e
+			}
+		}
+		req.Keys = parts[1:]
+
+	case "merkle", "merkle_keys":
+		// merkle level node,... [keyspace] or merkle_keys leaf,... [keyspace]
+		n := 3
+		if req.Cmd == "merkle_keys" {
+			n = 2
+		}
+		if len(parts) != n && len(parts) != n+1 {
+			return errors.New("invalid cmd")
+		}
+		for _, p := range append(strings.Split(parts[n-1], ","), parts[1:n-1]...) {
+			if _, e := strconv.Atoi(p); e != nil {
+				return e
+			}
+		}
+		if len(parts) == n+1 {
+			if _, e := ParseKeyspace(parts[n]); e != nil {
+				return e
+			}
+		}
+		req.Keys = parts[1:]
+
+	case "ring":
+		// ring epoch spec...
+		if len(parts) < 3 {
+			return errors.New("invalid cmd")
+		}
+		if _, e := strconv.ParseInt(parts[1], 10, 64); e != nil {
+			return e
+		}
+		req.Keys = parts[1:]
+
+	case "scan":
+		// scan cursor limit [prefix]
+		if len(parts) != 3 && len(parts) != 4 {
+			return errors.New("invalid cmd")
+		}
+		if _, e := DecodeCursor(parts[1]); e != nil {
+			return errors.New("invalid cursor")
+		}
+		if n, e := strconv.Atoi(parts[2]); e != nil || n < 1 || n > MaxScanLimit {
+			return errors.New("invalid limit")
+		}
+		if len(parts) == 4 && len(parts[3]) > MaxKeyLength {
+			return errors.New("prefix too long")
+		}
+		req.Keys = parts[1:]
 
 	case "stats":
 	case "quit", "version", "flush_all":
@@ -172,11 +431,44 @@ func (req *Request) Read(b *bufio.Reader) (e error) {
 	return
 }
 
+// The cursor of scan is sent as "0" for the first page, or after the last
+// one, and as the hex of a key otherwise.
+
+func EncodeCursor(cursor string) string {
+	if cursor == "" {
+		return "0"
+	}
+	return hex.EncodeToString([]byte(cursor))
+}
+
+func DecodeCursor(s string) (string, error) {
+	if s == "0" {
+		return "", nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return "", errors.New("invalid cursor")
+	}
+	return string(b), nil
+}
+
+func isWrite(cmd string) bool {
+	switch cmd {
+	case "set", "add", "replace", "append", "prepend", "cas",
+		"incr", "decr", "touch", "delete":
+		return true
+	}
+	return false
+}
+
 type Response struct {
 	status  string
 	msg     string
 	items   map[string]*Item
+	keys    []string // of scan, in order
 	noreply bool
+	cas     bool // write cas unique in VALUE lines
+	copies  bool // and exptime and tombstones, for the copies between nodes
 }
 
 func (resp *Response) String() (s string) {
@@ -201,13 +493,17 @@ func (resp *Response) Read(b *bufio.Reader) error {
 		switch resp.status {
 
 		case "VALUE":
-			if len(parts) < 3 {
+			if len(parts) < 4 {
 				return errors.New("invalid response")
 			}
 
 			key := parts[1]
 			// check key length
-			length, e2 := strconv.Atoi(parts[2])
+			flag, e2 := strconv.ParseUint(parts[2], 10, 32)
+			if e2 != nil {
+				return errors.New("invalid response")
+			}
+			length, e2 := strconv.Atoi(parts[3])
 			if e2 != nil {
 				return errors.New("invalid response")
 			}
@@ -215,7 +511,18 @@ func (resp *Response) Read(b *bufio.Reader) error {
 				return errors.New("body too large")
 			}
 
-			item := &Item{}
+			item := &Item{Flag: int(flag)}
+			if len(parts) > 4 {
+				if item.Cas, e2 = strconv.ParseUint(parts[4], 10, 64); e2 != nil {
+					return errors.New("invalid response")
+				}
+			}
+			if len(parts) > 5 {
+				if item.Exptime, e2 = strconv.Atoi(parts[5]); e2 != nil {
+					return errors.New("invalid response")
+				}
+			}
+			item.Deleted = len(parts) > 6 && parts[6] == "1"
 			// FIXME
 			if length > AllocLimit {
 				item.alloc = cmem.Alloc(uintptr(length))
@@ -240,6 +547,13 @@ func (resp *Response) Read(b *bufio.Reader) error {
 			resp.items[key] = item
 			continue
 
+		case "KEY":
+			if len(parts) != 2 {
+				return errors.New("invalid response")
+			}
+			resp.keys = append(resp.keys, parts[1])
+			continue
+
 		case "STAT":
 			if len(parts) != 3 {
 				return errors.New("invalid response")
@@ -250,18 +564,20 @@ func (resp *Response) Read(b *bufio.Reader) error {
 			continue
 
 		case "END":
-		case "STORED", "NOT_STORED", "DELETED", "NOT_FOUND":
+		case "STORED", "NOT_STORED", "EXISTS", "DELETED", "NOT_FOUND", "TOUCHED":
 		case "OK":
+		case "MIGRATE", "MERKLE", "VERSION", "RING", "MOVED", "SCAN", "PREFIX":
+			resp.msg = strings.Join(parts[1:], " ")
 
 		case "ERROR", "SERVER_ERROR", "CLIENT_ERROR":
 			if len(parts) > 1 {
-				resp.msg = parts[1]
+				resp.msg = strings.Join(parts[1:], " ")
 			}
 			log.Print("error:", resp)
 
 		default:
-			// try to convert to int
-			_, err := strconv.Atoi(resp.status)
+			// try to convert to a counter of incr, which takes 64 bits
+			_, err := strconv.ParseUint(resp.status, 10, 64)
 			if err != nil {
 				log.Print("unknown status:", s, resp.status)
 				return errors.New("unknown response:" + resp.status)
@@ -272,6 +588,23 @@ func (resp *Response) Read(b *bufio.Reader) error {
 	return nil
 }
 
+// err converts an error reply into a Go error.
+func (resp *Response) err() error {
+	switch resp.status {
+	case "CLIENT_ERROR":
+		if resp.msg == ErrNotNumeric.Error() {
+			return ErrNotNumeric
+		}
+		fallthrough
+	case "ERROR", "SERVER_ERROR":
+		return errors.New(resp.status + " " + resp.msg)
+	case "MOVED":
+		epoch, _ := strconv.ParseInt(resp.msg, 10, 64)
+		return &MovedError{epoch}
+	}
+	return nil
+}
+
 func (resp *Response) Write(w io.Writer) error {
 	if resp.noreply {
 		return nil
@@ -280,8 +613,20 @@ func (resp *Response) Write(w io.Writer) error {
 	switch resp.status {
 	case "VALUE":
 		for key, item := range resp.items {
-			fmt.Fprintf(w, "VALUE %s %d\r\n", key,
-				len(item.Body))
+			if resp.copies {
+				deleted := 0
+				if item.Deleted {
+					deleted = 1
+				}
+				fmt.Fprintf(w, "VALUE %s %d %d %d %d %d\r\n", key,
+					item.Flag, len(item.Body), item.Cas, item.Exptime, deleted)
+			} else if resp.cas {
+				fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key,
+					item.Flag, len(item.Body), item.Cas)
+			} else {
+				fmt.Fprintf(w, "VALUE %s %d %d\r\n", key,
+					item.Flag, len(item.Body))
+			}
 			if e := WriteFull(w, item.Body); e != nil {
 				return e
 			}
@@ -293,6 +638,12 @@ func (resp *Response) Write(w io.Writer) error {
 		io.WriteString(w, resp.msg)
 		io.WriteString(w, "END\r\n")
 
+	case "SCAN":
+		for _, key := range resp.keys {
+			io.WriteString(w, "KEY "+key+"\r\n")
+		}
+		io.WriteString(w, "SCAN "+resp.msg+"\r\n")
+
 	default:
 		io.WriteString(w, resp.status)
 		if resp.msg != "" {
@@ -323,19 +674,71 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 	resp = new(Response)
 	resp.noreply = req.NoReply
 
+	if req.Epoch > 0 && isWrite(req.Cmd) {
+		if r, ok := store.(Ringer); ok {
+			if epoch, owns := r.Owns(req.Keys[0], req.Epoch); !owns {
+				resp.status = "MOVED"
+				resp.msg = strconv.FormatInt(epoch, 10)
+				return resp
+			}
+		}
+	}
+
 	switch req.Cmd {
 
-	case "get":
-		if len(req.Key) > MaxKeyLength {
-			resp.status = "CLIENT_ERROR"
-			resp.msg = "key too long"
-			return resp
+	case "get", "gets", "fetch":
+		for _, key := range req.Keys {
+			if len(key) > MaxKeyLength {
+				resp.status = "CLIENT_ERROR"
+				resp.msg = "key too long"
+				return resp
+			}
 		}
 
 		resp.status = "VALUE"
+		resp.cas = req.Cmd == "gets"
+		resp.copies = req.Cmd == "fetch"
+
+		if c, ok := store.(Copier); ok && resp.copies {
+			items, err := c.Copies(req.Keys)
+			if err != nil {
+				resp.status = "SERVER_ERROR"
+				resp.msg = err.Error()
+				return resp
+			}
+			resp.items = items
+			hits := 0
+			for _, item := range items {
+				if !item.Deleted && !item.Expired() {
+					hits++
+					stat.bytes_written += int64(len(item.Body))
+				}
+			}
+			stat.cmd_get += int64(len(req.Keys))
+			stat.get_hits += int64(hits)
+			stat.get_misses += int64(len(req.Keys) - hits)
+			break
+		}
+
+		if len(req.Keys) > 1 || resp.copies {
+			items, err := store.GetMulti(req.Keys)
+			if err != nil {
+				resp.status = "SERVER_ERROR"
+				resp.msg = err.Error()
+				return resp
+			}
+			resp.items = items
+			stat.cmd_get += int64(len(req.Keys))
+			stat.get_hits += int64(len(items))
+			stat.get_misses += int64(len(req.Keys) - len(items))
+			for _, item := range items {
+				stat.bytes_written += int64(len(item.Body))
+			}
+			break
+		}
 
 		stat.cmd_get++
-		key := req.Key
+		key := req.Keys[0]
 		item, err := store.Get(key)
 		if err != nil {
 			resp.status = "SERVER_ERROR"
@@ -351,9 +754,22 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 			stat.bytes_written += int64(len(item.Body))
 		}
 
-	case "set":
-		key := req.Key
-		suc, err := store.Set(key, req.Item, req.NoReply)
+	case "set", "add", "replace", "append", "prepend":
+		key := req.Keys[0]
+		// a set carrying a cas unique is a copy between data nodes, a
+		// client would pin the key with a cas from the future
+		if _, ok := store.(Tombstoner); !ok && req.Item.Cas != 0 {
+			resp.status = "CLIENT_ERROR"
+			resp.msg = "copies are only accepted by data nodes"
+			break
+		}
+		f := storeFunc(store, req.Cmd)
+		if f == nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		suc, err := f(key, req.Item, req.NoReply)
 		if err != nil {
 			resp.status = "SERVER_ERROR"
 			resp.msg = err.Error()
@@ -368,9 +784,102 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 			resp.status = "NOT_STORED"
 		}
 
+	case "cas":
+		key := req.Keys[0]
+		s, ok := store.(Swapper)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		status, err := s.Cas(key, req.Item, req.NoReply)
+		if err != nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		resp.status = status
+		switch status {
+		case "STORED":
+			stat.cmd_set++
+			stat.bytes_read += int64(len(req.Item.Body))
+			stat.UpdateStat("cas_hits", 1)
+		case "EXISTS":
+			stat.UpdateStat("cas_badval", 1)
+		default:
+			stat.UpdateStat("cas_misses", 1)
+		}
+
+	case "incr", "decr":
+		key := req.Keys[0]
+		s, ok := store.(Incrementer)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		delta, _ := strconv.ParseInt(string(req.Item.Body), 10, 64)
+		if req.Cmd == "decr" {
+			delta = -delta
+		}
+		n, suc, err := s.Incr(key, delta, req.NoReply)
+		if err == ErrNotNumeric {
+			resp.status = "CLIENT_ERROR"
+			resp.msg = err.Error()
+			break
+		} else if err != nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		stat.UpdateStat("cmd_"+req.Cmd, 1)
+		if suc {
+			resp.status = strconv.FormatUint(n, 10)
+			stat.UpdateStat(req.Cmd+"_hits", 1)
+		} else {
+			resp.status = "NOT_FOUND"
+			stat.UpdateStat(req.Cmd+"_misses", 1)
+		}
+
+	case "touch":
+		key := req.Keys[0]
+		s, ok := store.(Toucher)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		suc, err := s.Touch(key, req.Item.Exptime, req.NoReply)
+		if err != nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		stat.UpdateStat("cmd_touch", 1)
+		if suc {
+			resp.status = "TOUCHED"
+			stat.UpdateStat("touch_hits", 1)
+		} else {
+			resp.status = "NOT_FOUND"
+			stat.UpdateStat("touch_misses", 1)
+		}
+
 	case "delete":
-		key := req.Key
-		suc, err := store.Delete(key)
+		key := req.Keys[0]
+		var suc bool
+		var err error
+		if req.Item != nil {
+			s, ok := store.(Tombstoner)
+			if !ok {
+				resp.status = "SERVER_ERROR"
+				resp.msg = "not supported"
+				break
+			}
+			// a copy is applied, or dropped for a newer version
+			suc, err = true, s.DeleteCopy(key, req.Item.Cas)
+		} else {
+			suc, err = store.Delete(key)
+		}
 		if err != nil {
 			resp.status = "SERVER_ERROR"
 			resp.msg = err.Error()
@@ -388,6 +897,11 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 		n := int64(store.Len())
 		st["curr_items"] = n
 		st["total_items"] = n
+		if r, ok := store.(Reporter); ok {
+			for k, v := range r.Stats() {
+				st[k] = v
+			}
+		}
 		resp.status = "STAT"
 		var ss []string
 		ss = make([]string, len(st))
@@ -406,6 +920,143 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 		store.FlushAll()
 		resp.status = "OK"
 
+	case "migrate", "migrate_status":
+		m, ok := store.(Migrator)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		var st *MigrateStatus
+		if req.Cmd == "migrate" {
+			left, _ := strconv.ParseUint(req.Keys[1], 10, 32)
+			right, _ := strconv.ParseUint(req.Keys[2], 10, 32)
+			var err error
+			if st, err = m.Migrate(req.Keys[0], uint32(left), uint32(right), keyspaceOf(req.Keys, 3)); err != nil {
+				resp.status = "SERVER_ERROR"
+				resp.msg = err.Error()
+				break
+			}
+		} else {
+			st = m.MigrateStatus(req.Keys[0])
+		}
+		if st == nil {
+			resp.status = "NOT_FOUND"
+		} else {
+			resp.status = "MIGRATE"
+			resp.msg = st.String()
+		}
+
+	case "delete_prefix", "delete_prefix_status":
+		d, ok := store.(PrefixDeleter)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		var st *PrefixStatus
+		if req.Cmd == "delete_prefix" {
+			cas, _ := strconv.ParseUint(req.Keys[1], 10, 64)
+			var err error
+			if st, err = d.DeletePrefix(req.Keys[0], cas, keyspaceOf(req.Keys, 2)); err != nil {
+				resp.status = "SERVER_ERROR"
+				resp.msg = err.Error()
+				break
+			}
+		} else {
+			st = d.DeletePrefixStatus(req.Keys[0])
+		}
+		if st == nil {
+			resp.status = "NOT_FOUND"
+		} else {
+			resp.status = "PREFIX"
+			resp.msg = st.String()
+		}
+
+	case "reclaim":
+		r, ok := store.(Reclaimer)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		cas, _ := strconv.ParseUint(req.Keys[0], 10, 64)
+		r.Reclaim(cas, keyspaceOf(req.Keys, 1))
+		resp.status = "OK"
+
+	case "ring":
+		r, ok := store.(Ringer)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		epoch, _ := strconv.ParseInt(req.Keys[0], 10, 64)
+		epoch, err := r.SetRing(epoch, strings.Join(req.Keys[1:], " "))
+		if err != nil {
+			resp.status = "CLIENT_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		resp.status = "RING"
+		resp.msg = strconv.FormatInt(epoch, 10)
+
+	case "scan":
+		s, ok := store.(Scanner)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		cursor, _ := DecodeCursor(req.Keys[0])
+		limit, _ := strconv.Atoi(req.Keys[1])
+		prefix := ""
+		if len(req.Keys) > 2 {
+			prefix = req.Keys[2]
+		}
+		keys, next, err := s.Scan(cursor, prefix, limit)
+		if err != nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		resp.status = "SCAN"
+		resp.keys = keys
+		resp.msg = EncodeCursor(next)
+
+	case "merkle", "merkle_keys":
+		m, ok := store.(Merkler)
+		if !ok {
+			resp.status = "SERVER_ERROR"
+			resp.msg = "not supported"
+			break
+		}
+		if req.Cmd == "merkle_keys" {
+			items, err := m.MerkleKeys(parseInts(req.Keys[0]), keyspaceOf(req.Keys, 1))
+			if err != nil {
+				resp.status = "SERVER_ERROR"
+				resp.msg = err.Error()
+				break
+			}
+			resp.status = "VALUE"
+			resp.copies = true
+			resp.items = items
+			break
+		}
+		level, _ := strconv.Atoi(req.Keys[0])
+		ds, err := m.Merkle(level, parseInts(req.Keys[1]), keyspaceOf(req.Keys, 2))
+		if err != nil {
+			resp.status = "SERVER_ERROR"
+			resp.msg = err.Error()
+			break
+		}
+		ss := make([]string, len(ds))
+		for i, d := range ds {
+			ss[i] = strconv.FormatUint(d, 10)
+		}
+		resp.status = "MERKLE"
+		resp.msg = strings.Join(ss, ",")
+
 	case "quit":
 		return nil
 
@@ -415,9 +1066,37 @@ func (req *Request) Process(store Storage, stat *Stats) (resp *Response) {
 		resp.status = "CLIENT_ERROR"
 		resp.msg = "invalid cmd"
 	}
+
+	// a delete of a missing key is copied too, the other replicas may
+	// still have it
+	if len(req.Replicas) > 0 && (changed(resp.status) ||
+		req.Cmd == "delete" && resp.status == "NOT_FOUND") {
+		if r, ok := store.(Replicator); ok {
+			r.Replicate(req.Keys[0], req.Replicas)
+		}
+	}
 	return resp
 }
 
+func parseInts(s string) []int {
+	ss := strings.Split(s, ",")
+	ns := make([]int, len(ss))
+	for i, v := range ss {
+		ns[i], _ = strconv.Atoi(v)
+	}
+	return ns
+}
+
+// changed tells whether a write command changed its key.
+func changed(status string) bool {
+	switch status {
+	case "STORED", "TOUCHED", "DELETED":
+		return true
+	}
+	_, e := strconv.ParseUint(status, 10, 64)
+	return e == nil
+}
+
 func contain(vs []string, v string) bool {
 	for _, i := range vs {
 		if i == v {
@@ -429,19 +1108,74 @@ func contain(vs []string, v string) bool {
 
 func (req *Request) Check(resp *Response) error {
 	switch req.Cmd {
-	case "get":
+	case "get", "gets", "fetch":
 		if resp.items != nil {
 			for key, _ := range resp.items {
-				if req.Key != key {
+				if !contain(req.Keys, key) {
 					log.Print("unexpected key in response: ", key)
 					return errors.New("unexpected key in response: " + key)
 				}
 			}
 		}
 
-	case "set":
+	case "set", "add", "replace", "append", "prepend", "cas":
 		if !contain([]string{"STORED", "NOT_STORED", "EXISTS", "NOT_FOUND"},
-			resp.status) {
+			resp.status) && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "incr", "decr":
+		if _, e := strconv.ParseUint(resp.status, 10, 64); e != nil &&
+			resp.status != "NOT_FOUND" && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "delete":
+		if !contain([]string{"DELETED", "NOT_FOUND"}, resp.status) &&
+			resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "touch":
+		if !contain([]string{"TOUCHED", "NOT_FOUND"}, resp.status) &&
+			resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "migrate", "migrate_status":
+		if !contain([]string{"MIGRATE", "NOT_FOUND"}, resp.status) &&
+			resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "delete_prefix", "delete_prefix_status":
+		if !contain([]string{"PREFIX", "NOT_FOUND"}, resp.status) &&
+			resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "merkle":
+		if resp.status != "MERKLE" && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "version":
+		if resp.status != "VERSION" && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "reclaim":
+		if resp.status != "OK" && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "ring":
+		if resp.status != "RING" && resp.err() == nil {
+			return errors.New("unexpected status: " + resp.status)
+		}
+
+	case "scan":
+		if resp.status != "SCAN" && resp.err() == nil {
 			return errors.New("unexpected status: " + resp.status)
 		}
 	}
@@ -8,6 +8,7 @@ import (
 	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -68,14 +69,14 @@ func (c *ServerConn) Serve(store Storage, stats *Stats) (e error) {
 		}
 
 		if AccessLog != nil {
-			key := req.Key
+			key := strings.Join(req.Keys, " ")
 			size := 0
 			switch req.Cmd {
-			case "get":
+			case "get", "gets", "fetch":
 				for _, v := range resp.items {
 					size += len(v.Body)
 				}
-			case "set":
+			case "set", "add", "replace", "append", "prepend", "cas":
 				size = len(req.Item.Body)
 			}
 			AccessLog.Printf("%s %s %s %d %dms", c.RemoteAddr, req.Cmd, key, size, dt.Nanoseconds()/1e6)
@@ -1,18 +1,423 @@
 package client
 
 import (
+	"bytes"
+	"caskdb/cmem"
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+var ErrNotNumeric = errors.New("cannot increment or decrement non-numeric value")
+
 type Storage interface {
 	Get(key string) (*Item, error)
+	GetMulti(keys []string) (map[string]*Item, error)
 	Set(key string, item *Item, noreply bool) (bool, error)
 	Delete(key string) (bool, error)
 	Len() int64
 	FlushAll()
 }
 
+// Optional capabilities of a Storage, the commands are answered with
+// SERVER_ERROR when the store does not implement them.
+
+type AddReplacer interface {
+	Add(key string, item *Item, noreply bool) (bool, error)
+	Replace(key string, item *Item, noreply bool) (bool, error)
+}
+
+type Appender interface {
+	Append(key string, item *Item, noreply bool) (bool, error)
+	Prepend(key string, item *Item, noreply bool) (bool, error)
+}
+
+// Incr adds delta to the decimal value of key, a negative delta
+// decrements it but never below zero.
+type Incrementer interface {
+	Incr(key string, delta int64, noreply bool) (uint64, bool, error)
+}
+
+type Toucher interface {
+	Touch(key string, exptime int, noreply bool) (bool, error)
+}
+
+// Cas stores item only if the cas unique of key is still item.Cas, it
+// replies STORED, EXISTS or NOT_FOUND.
+type Swapper interface {
+	Cas(key string, item *Item, noreply bool) (string, error)
+}
+
+// Scanner lists the keys starting with prefix in byte order, at most limit of
+// them after the key cursor, from the first one for an empty cursor. It also
+// returns the cursor of the next page, empty after the last one.
+type Scanner interface {
+	Scan(cursor, prefix string, limit int) ([]string, string, error)
+}
+
+// Tombstoner keeps a deleted key as a tombstone, a version with Deleted set
+// and no value, so that the older copies sent by a replica, a migration or a
+// repair do not bring the key back. Delete stores a tombstone even for a
+// missing key. The tombstone is copied as "delete key cas", which DeleteCopy
+// applies unless the stored version wins.
+type Tombstoner interface {
+	DeleteCopy(key string, cas uint64) error
+}
+
+// Copies returns the stored versions of keys the way fetch copies them
+// between nodes: the expired ones and the tombstones too, so that a newer
+// expiry or delete wins over the older values of the other replicas.
+type Copier interface {
+	Copies(keys []string) (map[string]*Item, error)
+}
+
+// Ringer keeps the ring pushed by the master with "ring <epoch> <spec>", see
+// RingSpec, and checks the writes a proxy sends with the epoch prefix: Owns
+// answers the epoch of the kept ring, and false for a key the server does not
+// replicate in it if epoch is older.
+type Ringer interface {
+	SetRing(epoch int64, spec string) (int64, error)
+	Owns(key string, epoch int64) (int64, bool)
+}
+
+// MovedError is the reply to a write for a key the server does not own in
+// its ring, which is newer than the one of the proxy.
+type MovedError struct {
+	Epoch int64
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("MOVED %d", e.Epoch)
+}
+
+// Reclaim lets the server drop the tombstones of ks older than cas, a
+// repair started at cas found every replica with them or newer versions. A
+// replica which missed a delete might bring the key back before that.
+type Reclaimer interface {
+	Reclaim(cas uint64, ks Keyspace)
+}
+
+// Replicate copies the current version of key to the servers addrs, it
+// follows a write sent with the replicate prefix.
+type Replicator interface {
+	Replicate(key string, addrs []string)
+}
+
+// Migrate starts copying the keys of ks in the ring range (left, right] to
+// addr, or returns the running copy of the same range. MigrateStatus
+// returns nil for an unknown id.
+type Migrator interface {
+	Migrate(addr string, left, right uint32, ks Keyspace) (*MigrateStatus, error)
+	MigrateStatus(id string) *MigrateStatus
+}
+
+// DeletePrefix starts replacing the keys of ks starting with prefix whose
+// version is older than cas by a tombstone of version cas, in the
+// background, or returns the running job of the same prefix.
+// DeletePrefixStatus returns nil for an unknown id.
+type PrefixDeleter interface {
+	DeletePrefix(prefix string, cas uint64, ks Keyspace) (*PrefixStatus, error)
+	DeletePrefixStatus(id string) *PrefixStatus
+}
+
+// Depth of the Merkle trees of the ring, a leaf covers 1<<(32-MerkleDepth)
+// positions.
+const MerkleDepth = 16
+
+// Merkle returns the digests of some nodes at a level of the Merkle tree of
+// the keys of ks, level 0 being the root; a server which cannot tell the
+// keys of ks apart in its tree may answer for more keys. MerkleKeys returns
+// the keys of ks under some leaves with their cas unique but no value.
+type Merkler interface {
+	Merkle(level int, nodes []int, ks Keyspace) ([]uint64, error)
+	MerkleKeys(leaves []int, ks Keyspace) (map[string]*Item, error)
+}
+
+// Stats returns statistics of the store added to the stats command.
+type Reporter interface {
+	Stats() map[string]int64
+}
+
+// MigrateStatus is the progress of copying a range, reported by the source
+// server as "id state scanned copied bytes errors".
+type MigrateStatus struct {
+	ID      string
+	State   string // RUNNING, DONE or FAILED
+	Scanned int64  // keys looked at
+	Copied  int64  // keys copied to the target
+	Bytes   int64  // size of the values copied
+	Errors  int64  // keys failed to copy
+}
+
+func (s *MigrateStatus) String() string {
+	return fmt.Sprintf("%s %s %d %d %d %d", s.ID, s.State, s.Scanned, s.Copied, s.Bytes, s.Errors)
+}
+
+func ParseMigrateStatus(s string) (*MigrateStatus, error) {
+	st := new(MigrateStatus)
+	_, err := fmt.Sscanf(s, "%s %s %d %d %d %d", &st.ID, &st.State,
+		&st.Scanned, &st.Copied, &st.Bytes, &st.Errors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid migrate status: %q", s)
+	}
+	return st, nil
+}
+
+// ScanPage picks the keys of a page of Scan out of keys added in any order.
+type ScanPage struct {
+	cursor, prefix string
+	limit          int
+	keys           []string
+	more           bool // keys were left out after the page
+}
+
+func NewScanPage(cursor, prefix string, limit int) *ScanPage {
+	return &ScanPage{cursor: cursor, prefix: prefix, limit: limit}
+}
+
+// Wants tells whether key is after the cursor and starts with the prefix.
+func (p *ScanPage) Wants(key string) bool {
+	return key > p.cursor && strings.HasPrefix(key, p.prefix)
+}
+
+func (p *ScanPage) Add(key string) {
+	if !p.Wants(key) {
+		return
+	}
+	p.keys = append(p.keys, key)
+	if len(p.keys) > 2*p.limit {
+		p.trim()
+	}
+}
+
+func (p *ScanPage) trim() {
+	sort.Strings(p.keys)
+	if len(p.keys) > p.limit {
+		p.keys = p.keys[:p.limit]
+		p.more = true
+	}
+}
+
+// Result returns the keys of the page in order, and the cursor of the next
+// page.
+func (p *ScanPage) Result() ([]string, string) {
+	p.trim()
+	if !p.more {
+		return p.keys, ""
+	}
+	return p.keys, p.keys[len(p.keys)-1]
+}
+
+// Keyspace is the part of the keys a ring holds, so that the repairs,
+// migrations and deletes of a ring leave alone the keys of the others on
+// the servers they share: the keys of namespace Only if it is set, else
+// the keys of no namespace in Skip.
+type Keyspace struct {
+	Only string
+	Skip []string
+}
+
+// namespaceOf returns ns of a key "ns:...", empty if it has none.
+func namespaceOf(key string) string {
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// Has tells whether key is in the keyspace.
+func (ks Keyspace) Has(key string) bool {
+	ns := namespaceOf(key)
+	if ks.Only != "" {
+		return ns == ks.Only
+	}
+	for _, s := range ks.Skip {
+		if ns == s {
+			return false
+		}
+	}
+	return true
+}
+
+// String is "+ns" for a namespace, "-ns,..." for the keys of no namespace
+// in the list, and "*" for all keys.
+func (ks Keyspace) String() string {
+	switch {
+	case ks.Only != "":
+		return "+" + ks.Only
+	case len(ks.Skip) > 0:
+		return "-" + strings.Join(ks.Skip, ",")
+	}
+	return "*"
+}
+
+// keyspaceOf returns the keyspace in args[i] of a command, all keys if it
+// was left out. It was checked by Read.
+func keyspaceOf(args []string, i int) Keyspace {
+	if i >= len(args) {
+		return Keyspace{}
+	}
+	ks, _ := ParseKeyspace(args[i])
+	return ks
+}
+
+// withKeyspace adds ks to the args of a command unless it holds all keys,
+// which the servers before keyspaces understand.
+func withKeyspace(args []string, ks Keyspace) []string {
+	if ks.Only == "" && len(ks.Skip) == 0 {
+		return args
+	}
+	return append(args, ks.String())
+}
+
+func ParseKeyspace(s string) (Keyspace, error) {
+	var ks Keyspace
+	var names []string
+	switch {
+	case s == "*":
+		return ks, nil
+	case len(s) > 1 && s[0] == '+':
+		ks.Only = s[1:]
+		names = []string{ks.Only}
+	case len(s) > 1 && s[0] == '-':
+		ks.Skip = strings.Split(s[1:], ",")
+		names = ks.Skip
+	}
+	if len(names) == 0 {
+		return ks, errors.New("invalid keyspace: " + s)
+	}
+	for _, ns := range names {
+		if ns == "" || strings.ContainsAny(ns, ":, \t\r\n") {
+			return ks, errors.New("invalid keyspace: " + s)
+		}
+	}
+	return ks, nil
+}
+
+// PrefixStatus is the progress of deleting a prefix, reported by the server
+// as "id state scanned deleted errors".
+type PrefixStatus struct {
+	ID      string
+	State   string // RUNNING, DONE or FAILED
+	Scanned int64  // keys looked at
+	Deleted int64  // keys replaced by a tombstone
+	Errors  int64  // keys failed to delete
+}
+
+func (s *PrefixStatus) String() string {
+	return fmt.Sprintf("%s %s %d %d %d", s.ID, s.State, s.Scanned, s.Deleted, s.Errors)
+}
+
+func ParsePrefixStatus(s string) (*PrefixStatus, error) {
+	st := new(PrefixStatus)
+	_, err := fmt.Sscanf(s, "%s %s %d %d %d", &st.ID, &st.State,
+		&st.Scanned, &st.Deleted, &st.Errors)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delete prefix status: %q", s)
+	}
+	return st, nil
+}
+
+func storeFunc(store Storage, cmd string) func(string, *Item, bool) (bool, error) {
+	switch cmd {
+	case "set":
+		return store.Set
+	case "add", "replace":
+		if s, ok := store.(AddReplacer); ok {
+			if cmd == "add" {
+				return s.Add
+			}
+			return s.Replace
+		}
+	case "append", "prepend":
+		if s, ok := store.(Appender); ok {
+			if cmd == "append" {
+				return s.Append
+			}
+			return s.Prepend
+		}
+	}
+	return nil
+}
+
+var casLock sync.Mutex
+var lastCas uint64
+
+// The cas unique is the version of an item, a hybrid logical clock: it is
+// taken from the clock so that it keeps increasing after a restart, and it
+// moves past the versions copied from other nodes so that a later write
+// wins even if the clock of this node is behind.
+
+// NewCas returns an increasing cas unique.
+func NewCas() uint64 {
+	casLock.Lock()
+	defer casLock.Unlock()
+
+	cas := uint64(time.Now().UnixNano())
+	if cas <= lastCas {
+		cas = lastCas + 1
+	}
+	lastCas = cas
+	return cas
+}
+
+// ObserveCas moves the clock past a version written by another node.
+func ObserveCas(cas uint64) {
+	casLock.Lock()
+	defer casLock.Unlock()
+
+	if cas > lastCas {
+		lastCas = cas
+	}
+}
+
+// Newer tells whether version a wins over b, a missing version loses. The
+// higher cas unique wins, and two different values written with the same
+// one are ordered by their content, so that all replicas keep the same. A
+// tombstone wins over a value of the same version.
+func Newer(a, b *Item) bool {
+	if b == nil {
+		return true
+	}
+	if a == nil {
+		return false
+	}
+	if a.Cas != b.Cas {
+		return a.Cas > b.Cas
+	}
+	if a.Deleted != b.Deleted {
+		return a.Deleted
+	}
+	if c := bytes.Compare(a.Body, b.Body); c != 0 {
+		return c > 0
+	}
+	if a.Flag != b.Flag {
+		return a.Flag > b.Flag
+	}
+	return a.Exptime > b.Exptime
+}
+
+// IncrBody applies delta to body the way memcached does: incr wraps
+// around at 64 bits and decr stops at zero.
+func IncrBody(body []byte, delta int64) (uint64, error) {
+	n, err := strconv.ParseUint(string(body), 10, 64)
+	if err != nil {
+		return 0, ErrNotNumeric
+	}
+	if delta >= 0 {
+		n += uint64(delta)
+	} else if uint64(-delta) > n {
+		n = 0
+	} else {
+		n -= uint64(-delta)
+	}
+	return n, nil
+}
+
 type mapStore struct {
 	lock sync.Mutex
 	data map[string]*Item
@@ -28,8 +433,19 @@ func (s *mapStore) Get(key string) (*Item, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
+	return s.get(key), nil
+}
+
+func (s *mapStore) get(key string) *Item {
 	r, _ := s.data[key]
-	return r, nil
+	if r != nil && r.Deleted {
+		return nil
+	}
+	if r != nil && r.Expired() {
+		delete(s.data, key)
+		return nil
+	}
+	return r
 }
 
 func (s *mapStore) GetMulti(keys []string) (map[string]*Item, error) {
@@ -38,67 +454,206 @@ func (s *mapStore) GetMulti(keys []string) (map[string]*Item, error) {
 
 	rs := make(map[string]*Item, len(keys))
 	for _, key := range keys {
-		r, _ := s.data[key]
-		if r != nil {
+		if r := s.get(key); r != nil {
 			rs[key] = r
 		}
 	}
 	return rs, nil
 }
 
+// store keeps a copy of item, a set forwarded by a replica already
+// carries its cas unique and is dropped if the stored version wins.
+func (s *mapStore) store(key string, item *Item) {
+	it := *item
+	item.alloc = nil
+	if it.Cas == 0 {
+		it.Cas = NewCas()
+	} else {
+		ObserveCas(it.Cas)
+		if r := s.data[key]; r != nil && !Newer(&it, r) {
+			if it.alloc != nil {
+				cmem.Free(it.alloc, uintptr(cap(it.Body)))
+			}
+			return
+		}
+	}
+	s.data[key] = &it
+}
+
 func (s *mapStore) Set(key string, item *Item, noreply bool) (bool, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	it := *item
-	item.alloc = nil
+	s.store(key, item)
+	return true, nil
+}
+
+func (s *mapStore) Add(key string, item *Item, noreply bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(key) != nil {
+		return false, nil
+	}
+	item.Cas = 0
+	s.store(key, item)
+	return true, nil
+}
+
+func (s *mapStore) Replace(key string, item *Item, noreply bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.get(key) == nil {
+		return false, nil
+	}
+	item.Cas = 0
+	s.store(key, item)
+	return true, nil
+}
+
+func (s *mapStore) Append(key string, item *Item, noreply bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.get(key)
+	if r == nil {
+		return false, nil
+	}
+	it := *r
+	it.alloc = nil
+	it.Cas = NewCas()
+	it.Body = make([]byte, 0, len(r.Body)+len(item.Body))
+	it.Body = append(append(it.Body, r.Body...), item.Body...)
+	s.data[key] = &it
+	return true, nil
+}
+
+func (s *mapStore) Prepend(key string, item *Item, noreply bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.get(key)
+	if r == nil {
+		return false, nil
+	}
+	it := *r
+	it.alloc = nil
+	it.Cas = NewCas()
+	it.Body = make([]byte, 0, len(r.Body)+len(item.Body))
+	it.Body = append(append(it.Body, item.Body...), r.Body...)
 	s.data[key] = &it
 	return true, nil
 }
 
-func (s *mapStore) Append(key string, value []byte) (suc bool, err error) {
+func (s *mapStore) Incr(key string, delta int64, noreply bool) (uint64, bool, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	r, ok := s.data[key]
-	if ok {
-		r.Body = append(r.Body, value...)
-		s.data[key] = r
-		return true, nil
+	r := s.get(key)
+	if r == nil {
+		return 0, false, nil
 	}
-	return false, nil
+	n, err := IncrBody(r.Body, delta)
+	if err != nil {
+		return 0, false, err
+	}
+	it := *r
+	it.alloc = nil
+	it.Cas = NewCas()
+	it.Body = []byte(strconv.FormatUint(n, 10))
+	s.data[key] = &it
+	return n, true, nil
 }
 
-func (s *mapStore) Incr(key string, v int) (n int, err error) {
+func (s *mapStore) Cas(key string, item *Item, noreply bool) (string, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	r, ok := s.data[key]
-	if ok {
-		n, err = strconv.Atoi(string(r.Body))
-		if err != nil {
-			return
-		}
-		n += v
-		r.Body = []byte(strconv.Itoa(n))
-	} else {
-		n = 0
+
+	r := s.get(key)
+	if r == nil {
+		return "NOT_FOUND", nil
 	}
-	return
+	if r.Cas != item.Cas {
+		return "EXISTS", nil
+	}
+	item.Cas = 0
+	s.store(key, item)
+	return "STORED", nil
+}
+
+func (s *mapStore) Touch(key string, exptime int, noreply bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	r := s.get(key)
+	if r == nil {
+		return false, nil
+	}
+	it := *r
+	it.alloc = nil
+	it.Cas = NewCas()
+	it.Exptime = exptime
+	s.data[key] = &it
+	return true, nil
 }
 
 func (s *mapStore) Delete(key string) (r bool, err error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	_, ok := s.data[key]
-	if ok {
-		delete(s.data, key)
-		r = true
+	r = s.get(key) != nil
+	if old := s.data[key]; old == nil || !old.Deleted {
+		s.store(key, &Item{Deleted: true})
 	}
 	return
 }
 
+func (s *mapStore) DeleteCopy(key string, cas uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.store(key, &Item{Cas: cas, Deleted: true})
+	return nil
+}
+
+func (s *mapStore) Copies(keys []string) (map[string]*Item, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	rs := make(map[string]*Item, len(keys))
+	for _, key := range keys {
+		if r := s.data[key]; r != nil {
+			rs[key] = r
+		}
+	}
+	return rs, nil
+}
+
+func (s *mapStore) Scan(cursor, prefix string, limit int) ([]string, string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	page := NewScanPage(cursor, prefix, limit)
+	for key, r := range s.data {
+		if !r.Deleted && !r.Expired() {
+			page.Add(key)
+		}
+	}
+	keys, next := page.Result()
+	return keys, next, nil
+}
+
 func (s *mapStore) Len() int64 {
-	return int64(len(s.data))
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	n := 0
+	for _, r := range s.data {
+		if !r.Deleted {
+			n++
+		}
+	}
+	return int64(n)
 }
 
 func (s *mapStore) FlushAll() {
@@ -5,127 +5,615 @@ import (
 	"caskdb/protocol"
 	"flag"
 	"fmt"
-	"hash/crc32"
 	"log"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type BitcaskStore struct {
-	bc  *Bitcask
-	chF chan func()
+	sync.Mutex // serializes read-modify-write commands
+	bc         *namespaces
+	hostsLock  sync.Mutex
+	hosts      map[string]*protocol.Host // replicas to forward to
+	hintsLock  sync.Mutex
+	hints      map[string]*hintQueue // by replica
+	hintDir    string
+	tree       *merkleTree            // of all keys, for repairs
+	keys       *keyIndex              // by leaf of tree and in order
+	nsTrees    map[string]*merkleTree // of the keys of every namespace
+	hash       protocol.HashMethod    // same as the ring of the master
+	hashName   string
+	jobsLock   sync.Mutex
+	jobs       map[string]*migrateJob // by id
+	prefixJobs map[string]*prefixJob  // by id
+	lastJob    int
+	ringLock   sync.Mutex
+	ring       *protocol.RingOwner // pushed by the master, nil until then
+	epoch      int64
+	grace      time.Duration // tombstones are kept that long
+	marksLock  sync.Mutex
+	marks      map[string]reclaimMark // of the clean repairs by keyspace, see Reclaim
 }
 
-func crc32hash(s []byte) uint32 {
-	hash := crc32.NewIEEE()
-	hash.Write(s)
-	return hash.Sum32()
+// migrateJob is a copy of a ring range running in the background.
+type migrateJob struct {
+	addr        string
+	left, right uint32
+	ks          protocol.Keyspace
+	st          protocol.MigrateStatus
+	end         time.Time
 }
 
+// prefixJob is a delete prefix running in the background.
+type prefixJob struct {
+	prefix string
+	cas    uint64
+	ks     protocol.Keyspace
+	st     protocol.PrefixStatus
+	end    time.Time
+}
+
+// reclaimMark is the start of the last clean repair of the ring holding ks.
+type reclaimMark struct {
+	ks  protocol.Keyspace
+	cas uint64
+}
+
+// keep finished jobs for the master to see how they ended
+const jobKeepTime = time.Hour
+
 func NewStore(c Config) *BitcaskStore {
 	b := new(BitcaskStore)
-	b.bc = new(Bitcask)
-	b.chF = make(chan func(), 100)
-	go b.backend()
+	b.hosts = make(map[string]*protocol.Host)
+	b.hints = make(map[string]*hintQueue)
+	b.hintDir = c.HintPath
+	if b.hintDir == "" {
+		b.hintDir = c.Path + "-hints"
+	}
+	b.jobs = make(map[string]*migrateJob)
+	b.prefixJobs = make(map[string]*prefixJob)
+	b.grace = c.TombstoneGrace
+	b.marks = make(map[string]reclaimMark)
+	b.hash, b.hashName = protocol.HashMethods[c.Hash], c.Hash
+	if b.hash == nil {
+		panic("unknown hash method: " + c.Hash)
+	}
 	var err error
-	b.bc, err = NewBitcask(c.Options)
+	b.bc, err = openNamespaces(c.Options, c.Namespaces)
 	if err != nil {
-		panic("Can not open db:" + c.Path + err.Error())
+		panic("Can not open db:" + err.Error())
+	}
+	b.tree = newMerkleTree()
+	b.keys = newKeyIndex(b.hash)
+	b.nsTrees = make(map[string]*merkleTree)
+	for _, ns := range c.Namespaces {
+		b.nsTrees[ns.Name] = newMerkleTree()
+	}
+	b.buildTree()
+	if err = b.openHints(); err != nil {
+		panic("Can not open hints:" + b.hintDir + err.Error())
+	}
+	go b.reclaim(c.MergeWindow, b.bc.def)
+	for _, ns := range c.Namespaces {
+		go b.reclaim(ns.MergeWindow, b.bc.bcs[ns.Name])
 	}
 	return b
 }
 
-func (self *BitcaskStore) backend() {
-	for f := range self.chF {
-		f()
-	}
-
-}
 func (self *BitcaskStore) Close() error {
+	self.closeHints()
 	if err := self.bc.Close(); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (self *BitcaskStore) migrate(host string, left, right uint32) {
+// inRange tells whether v is in the ring range (left, right], which wraps
+// around when left >= right.
+func inRange(v, left, right uint32) bool {
+	if left < right {
+		return v > left && v <= right
+	}
+	return v > left || v <= right
+}
+
+// migrate copies the keys of ks in (left, right] to host, counting its
+// progress in st.
+func (self *BitcaskStore) migrate(host string, left, right uint32, ks protocol.Keyspace, st *protocol.MigrateStatus) {
 	keyChan := self.bc.Keys()
-	target := protocol.NewHost(host)
+	target := self.getHost(host)
 	for key := range keyChan {
-		v := crc32hash([]byte(key))
-		if (left < right && v >= left && v < right) ||
-			(left > right && !(v >= left && v < right)) {
-			v, e := self.bc.Get(key)
-			if e == nil {
-				target.Set(key, &protocol.Item{Body: v}, false)
+		atomic.AddInt64(&st.Scanned, 1)
+		v := self.hash([]byte(key))
+		if inRange(v, left, right) && ks.Has(key) {
+			// tombstones too, or the target keeps the deleted keys
+			if item := self.stored(key); item != nil {
+				if ok, e := target.Set(key, item, false); e != nil || !ok {
+					atomic.AddInt64(&st.Errors, 1)
+				} else {
+					atomic.AddInt64(&st.Copied, 1)
+					atomic.AddInt64(&st.Bytes, int64(len(item.Body)))
+				}
+			}
+		}
+	}
+}
+
+func (self *BitcaskStore) Migrate(addr string, left, right uint32, ks protocol.Keyspace) (*protocol.MigrateStatus, error) {
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	for id, job := range self.jobs {
+		if job.st.State != "RUNNING" && time.Since(job.end) > jobKeepTime {
+			delete(self.jobs, id)
+		}
+	}
+	for _, job := range self.jobs {
+		if job.st.State == "RUNNING" && job.addr == addr && job.left == left && job.right == right &&
+			job.ks.String() == ks.String() {
+			return job.status(), nil
+		}
+	}
+
+	self.lastJob++
+	job := &migrateJob{addr: addr, left: left, right: right, ks: ks}
+	job.st = protocol.MigrateStatus{ID: strconv.Itoa(self.lastJob), State: "RUNNING"}
+	self.jobs[job.st.ID] = job
+	log.Println("migrate", job.st.ID, addr, left, right, ks)
+	go func() {
+		self.migrate(addr, left, right, ks, &job.st)
+		self.jobsLock.Lock()
+		job.st.State = "DONE"
+		if atomic.LoadInt64(&job.st.Errors) > 0 {
+			job.st.State = "FAILED"
+		}
+		job.end = time.Now()
+		self.jobsLock.Unlock()
+		log.Println("migrate", job.st.ID, job.st.State)
+	}()
+	return job.status(), nil
+}
+
+func (self *BitcaskStore) MigrateStatus(id string) *protocol.MigrateStatus {
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	if job, ok := self.jobs[id]; ok {
+		return job.status()
+	}
+	return nil
+}
+
+// status returns a snapshot of the progress, with jobsLock held.
+func (job *migrateJob) status() *protocol.MigrateStatus {
+	st := &job.st
+	return &protocol.MigrateStatus{ID: st.ID, State: st.State,
+		Scanned: atomic.LoadInt64(&st.Scanned), Copied: atomic.LoadInt64(&st.Copied),
+		Bytes: atomic.LoadInt64(&st.Bytes), Errors: atomic.LoadInt64(&st.Errors)}
+}
+
+// deletePrefix replaces the keys of ks starting with prefix older than cas
+// by a tombstone of version cas, counting its progress in st. The same
+// tombstone is written by every replica, so they need no copy.
+func (self *BitcaskStore) deletePrefix(prefix string, cas uint64, ks protocol.Keyspace, st *protocol.PrefixStatus) {
+	protocol.ObserveCas(cas)
+	for key := range self.bc.Keys() {
+		atomic.AddInt64(&st.Scanned, 1)
+		if !strings.HasPrefix(key, prefix) || !ks.Has(key) {
+			continue
+		}
+		self.Lock()
+		if old := self.stored(key); old != nil && !old.Deleted && old.Cas < cas {
+			if _, e := self.set(key, &protocol.Item{Cas: cas, Deleted: true}); e != nil {
+				atomic.AddInt64(&st.Errors, 1)
+			} else {
+				atomic.AddInt64(&st.Deleted, 1)
+			}
+		}
+		self.Unlock()
+	}
+}
+
+func (self *BitcaskStore) DeletePrefix(prefix string, cas uint64, ks protocol.Keyspace) (*protocol.PrefixStatus, error) {
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	for id, job := range self.prefixJobs {
+		if job.st.State != "RUNNING" && time.Since(job.end) > jobKeepTime {
+			delete(self.prefixJobs, id)
+		}
+	}
+	for _, job := range self.prefixJobs {
+		if job.st.State == "RUNNING" && job.prefix == prefix && job.cas == cas && job.ks.String() == ks.String() {
+			return job.status(), nil
+		}
+	}
+
+	self.lastJob++
+	job := &prefixJob{prefix: prefix, cas: cas, ks: ks}
+	job.st = protocol.PrefixStatus{ID: strconv.Itoa(self.lastJob), State: "RUNNING"}
+	self.prefixJobs[job.st.ID] = job
+	log.Println("delete prefix", job.st.ID, prefix, cas, ks)
+	go func() {
+		self.deletePrefix(prefix, cas, ks, &job.st)
+		self.jobsLock.Lock()
+		job.st.State = "DONE"
+		if atomic.LoadInt64(&job.st.Errors) > 0 {
+			job.st.State = "FAILED"
+		}
+		job.end = time.Now()
+		self.jobsLock.Unlock()
+		log.Println("delete prefix", job.st.ID, job.st.State)
+	}()
+	return job.status(), nil
+}
+
+func (self *BitcaskStore) DeletePrefixStatus(id string) *protocol.PrefixStatus {
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	if job, ok := self.prefixJobs[id]; ok {
+		return job.status()
+	}
+	return nil
+}
+
+// status returns a snapshot of the progress, with jobsLock held.
+func (job *prefixJob) status() *protocol.PrefixStatus {
+	st := &job.st
+	return &protocol.PrefixStatus{ID: st.ID, State: st.State,
+		Scanned: atomic.LoadInt64(&st.Scanned), Deleted: atomic.LoadInt64(&st.Deleted),
+		Errors: atomic.LoadInt64(&st.Errors)}
+}
+
+func inWindow(hour int, window [2]int) bool {
+	if window[0] <= window[1] {
+		return hour >= window[0] && hour <= window[1]
+	}
+	return hour >= window[0] || hour <= window[1]
+}
+
+// reclaim deletes expired items and the reclaimable tombstones of bc during
+// its merge window, so that the following bitcask merge drops them from the
+// data files.
+func (self *BitcaskStore) reclaim(window [2]int, bc *Bitcask) {
+	for {
+		time.Sleep(time.Hour)
+		if !inWindow(time.Now().Hour(), window) {
+			continue
+		}
+		n, m := self.reclaimKeys(bc)
+		log.Println("reclaimed", n, "expired items and", m, "tombstones")
+	}
+}
+
+// reclaimKeys deletes the reclaimable items of bc, it returns the number of
+// expired items and of tombstones deleted.
+func (self *BitcaskStore) reclaimKeys(bc *Bitcask) (n, m int) {
+	for key := range bc.Keys() {
+		if item := self.stored(key); item == nil || !self.reclaimable(key, item) {
+			continue
+		}
+		self.Lock()
+		if old := self.stored(key); old != nil && self.reclaimable(key, old) {
+			self.del(key)
+			if old.Deleted {
+				m++
+			} else {
+				n++
 			}
 		}
+		self.Unlock()
+	}
+	return
+}
+
+// Reclaim is pushed by the master after a repair of the ring holding ks,
+// started at cas, found no difference left between the replicas. The rings
+// sharing the server are repaired apart.
+func (self *BitcaskStore) Reclaim(cas uint64, ks protocol.Keyspace) {
+	self.marksLock.Lock()
+	defer self.marksLock.Unlock()
+	if m, ok := self.marks[ks.String()]; !ok || cas > m.cas {
+		self.marks[ks.String()] = reclaimMark{ks, cas}
+	}
+}
+
+// reclaimable tells whether item of key is expired, or a tombstone older
+// than the grace period which a clean repair of its ring found on every
+// replica. The cas unique of the tombstone is the time of the delete.
+// Dropping it before then lets a replica which missed the delete bring the
+// key back with the next repair.
+func (self *BitcaskStore) reclaimable(key string, item *protocol.Item) bool {
+	if !item.Deleted {
+		return item.Expired()
+	}
+	if time.Since(time.Unix(0, int64(item.Cas))) <= self.grace {
+		return false
+	}
+	self.marksLock.Lock()
+	defer self.marksLock.Unlock()
+	for _, m := range self.marks {
+		if m.ks.Has(key) && item.Cas < m.cas {
+			return true
+		}
 	}
+	return false
 }
 
 func (self *BitcaskStore) FlushAll() {
 	self.bc.Sync()
 }
 
-//get @#$localhost:7902-3679577973-1113110223 8 0ms
-func extract(str string) (string, uint32, uint32) {
-	posA := strings.Index(str, "-")
-	posL := strings.LastIndex(str, "-")
-	addr := str[:posA]
-	log.Println(str[posA+1:posL], str[posL+1:])
-	left, _ := strconv.ParseUint(str[posA+1:posL], 10, 32)
-	right, _ := strconv.ParseUint(str[posL+1:], 10, 32)
-	return addr, uint32(left), uint32(right)
-}
 func (self *BitcaskStore) Get(key string) (*protocol.Item, error) {
-	self.bc.Sync()
-	if len(key) > 3 && key[0:3] == "@#$" {
-		addr, left, right := extract(key[3:])
-		log.Println(addr, left, right)
-		go self.migrate(addr, left, right)
-		return &protocol.Item{Body: []byte("TRUST ME")}, nil
-	}
+	self.bc.of(key).Sync()
+	item, err := self.get(key)
+	self.bc.countGet(key, item != nil)
+	return item, err
+}
+
+func (self *BitcaskStore) get(key string) (*protocol.Item, error) {
 	v, err := self.bc.Get(key)
 	if err != nil {
 		return nil, err
 	}
-	return &protocol.Item{Body: v}, nil
+	item, err := decodeItem(v)
+	if err != nil || item.Deleted || item.Expired() {
+		return nil, err
+	}
+	return item, nil
 }
 
-func (self *BitcaskStore) Set(key string, item *protocol.Item, noreply bool) (bool, error) {
-	if len(key) > 3 && strings.Contains(key, "@#$") {
-		pos := strings.Index(key, "@#$")
-		target := protocol.NewHost(key[pos+3:])
-		key = key[:pos]
-		self.chF <- func() {
-			for {
-				if ok, _ := target.Set(key, item, noreply); ok {
-					break
-				}
+// Missing keys are simply left out of the result, the same way a failed
+// single get shows up as a miss on the proxy.
+func (self *BitcaskStore) GetMulti(keys []string) (map[string]*protocol.Item, error) {
+	self.bc.Sync()
+	rs := make(map[string]*protocol.Item, len(keys))
+	for _, key := range keys {
+		item, err := self.get(key)
+		if err == nil && item != nil {
+			rs[key] = item
+		}
+		self.bc.countGet(key, rs[key] != nil)
+	}
+	return rs, nil
+}
+
+// Copies returns the stored versions of keys, tombstones and expired items
+// included, see protocol.Copier.
+func (self *BitcaskStore) Copies(keys []string) (map[string]*protocol.Item, error) {
+	self.bc.Sync()
+	rs := make(map[string]*protocol.Item, len(keys))
+	for _, key := range keys {
+		item := self.stored(key)
+		if item != nil {
+			rs[key] = item
+		}
+		self.bc.countGet(key, item != nil && !item.Deleted && !item.Expired())
+	}
+	return rs, nil
+}
+
+func (self *BitcaskStore) getHost(addr string) *protocol.Host {
+	self.hostsLock.Lock()
+	defer self.hostsLock.Unlock()
+	h, ok := self.hosts[addr]
+	if !ok {
+		h = protocol.NewHost(addr)
+		self.hosts[addr] = h
+	}
+	return h
+}
+
+// Replicate hands the stored version to the other replicas in parallel, a
+// tombstone included, see hintQueue.
+func (self *BitcaskStore) Replicate(key string, addrs []string) {
+	item := self.stored(key)
+	if item == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		q, err := self.hintQueue(addr)
+		if err != nil {
+			log.Println("open hints for", addr, "failed:", err)
+			continue
+		}
+		wg.Add(1)
+		go func(addr string, q *hintQueue) {
+			defer wg.Done()
+			if err := q.push(key, item); err != nil && err != errHintsFull {
+				log.Println("write hint for", addr, "failed:", err)
 			}
+		}(addr, q)
+	}
+	wg.Wait()
+}
+
+// set stores item under a new cas unique, unless it is a copy forwarded
+// by a replica, a migration or a repair which already carries one. Such a
+// copy is dropped if the stored version wins, see protocol.Newer.
+func (self *BitcaskStore) set(key string, item *protocol.Item) (bool, error) {
+	if !item.Deleted {
+		self.bc.countSet(key)
+	}
+	if item.Cas == 0 {
+		item.Cas = protocol.NewCas()
+	} else {
+		protocol.ObserveCas(item.Cas)
+		if !protocol.Newer(item, self.stored(key)) {
+			return true, nil
 		}
 	}
-	e := self.bc.Set(key, item.Body)
+	old := self.stored(key)
+	e := self.bc.Set(key, encodeItem(item))
 	if e != nil {
 		return false, e
 	}
+	self.changed(key, old, item)
 	return true, nil
 }
 
+func (self *BitcaskStore) del(key string) error {
+	old := self.stored(key)
+	if e := self.bc.Del(key); e != nil {
+		return e
+	}
+	self.changed(key, old, nil)
+	return nil
+}
+
+// update stores item as a new version of key.
+func (self *BitcaskStore) update(key string, item *protocol.Item) (bool, error) {
+	item.Cas = 0
+	return self.set(key, item)
+}
+
+func (self *BitcaskStore) Set(key string, item *protocol.Item, noreply bool) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	return self.set(key, item)
+}
+
+func (self *BitcaskStore) Add(key string, item *protocol.Item, noreply bool) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	if old, _ := self.get(key); old != nil {
+		return false, nil
+	}
+	return self.update(key, item)
+}
+
+func (self *BitcaskStore) Replace(key string, item *protocol.Item, noreply bool) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	if old, _ := self.get(key); old == nil {
+		return false, nil
+	}
+	return self.update(key, item)
+}
+
+func (self *BitcaskStore) Cas(key string, item *protocol.Item, noreply bool) (string, error) {
+	self.Lock()
+	defer self.Unlock()
+	old, _ := self.get(key)
+	if old == nil {
+		return "NOT_FOUND", nil
+	}
+	if old.Cas != item.Cas {
+		return "EXISTS", nil
+	}
+	if _, e := self.update(key, item); e != nil {
+		return "", e
+	}
+	return "STORED", nil
+}
+
+func (self *BitcaskStore) concat(key string, item *protocol.Item, noreply, prepend bool) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	old, _ := self.get(key)
+	if old == nil {
+		return false, nil
+	}
+	body := make([]byte, 0, len(old.Body)+len(item.Body))
+	if prepend {
+		body = append(append(body, item.Body...), old.Body...)
+	} else {
+		body = append(append(body, old.Body...), item.Body...)
+	}
+	old.Body = body
+	return self.update(key, old)
+}
+
+func (self *BitcaskStore) Append(key string, item *protocol.Item, noreply bool) (bool, error) {
+	return self.concat(key, item, noreply, false)
+}
+
+func (self *BitcaskStore) Prepend(key string, item *protocol.Item, noreply bool) (bool, error) {
+	return self.concat(key, item, noreply, true)
+}
+
+func (self *BitcaskStore) Incr(key string, delta int64, noreply bool) (uint64, bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	old, _ := self.get(key)
+	if old == nil {
+		return 0, false, nil
+	}
+	n, e := protocol.IncrBody(old.Body, delta)
+	if e != nil {
+		return 0, false, e
+	}
+	old.Body = []byte(strconv.FormatUint(n, 10))
+	if _, e = self.update(key, old); e != nil {
+		return 0, false, e
+	}
+	return n, true, nil
+}
+
+func (self *BitcaskStore) Touch(key string, exptime int, noreply bool) (bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	old, _ := self.get(key)
+	if old == nil {
+		return false, nil
+	}
+	old.Exptime = exptime
+	return self.update(key, old)
+}
+
+// Scan resumes from the cursor in the index of the keys, see
+// protocol.Scanner. A key written during a scan may be left out, as it is
+// when it sorts before the cursor.
+func (self *BitcaskStore) Scan(cursor, prefix string, limit int) ([]string, string, error) {
+	page := protocol.NewScanPage(cursor, prefix, limit)
+	start := cursor
+	if prefix > start {
+		start = prefix
+	}
+	n := 0
+	self.keys.scan(start, func(key string, m keyMeta) bool {
+		if !strings.HasPrefix(key, prefix) || n > limit {
+			return false
+		}
+		if page.Wants(key) && m.live() {
+			page.Add(key)
+			n++
+		}
+		return true
+	})
+	keys, next := page.Result()
+	return keys, next, nil
+}
+
 func (self *BitcaskStore) Len() int64 {
 	return self.bc.Len()
 }
 
+// Delete replaces the stored version by a tombstone, which keeps the older
+// copies from coming back, see protocol.Tombstoner.
 func (self *BitcaskStore) Delete(key string) (bool, error) {
-	e := self.bc.Del(key)
-	if e != nil {
+	self.Lock()
+	defer self.Unlock()
+	self.bc.countDelete(key)
+	old := self.stored(key)
+	if old != nil && old.Deleted {
+		return false, nil
+	}
+	if _, e := self.set(key, &protocol.Item{Deleted: true}); e != nil {
 		return false, e
-	} else {
-		return true, nil
 	}
+	return old != nil && !old.Expired(), nil
+}
+
+func (self *BitcaskStore) DeleteCopy(key string, cas uint64) error {
+	self.Lock()
+	defer self.Unlock()
+	self.bc.countDelete(key)
+	_, e := self.set(key, &protocol.Item{Cas: cas, Deleted: true})
+	return e
 }
 
 var listen *string = flag.String("listen", "0.0.0.0", "address to listen")
@@ -139,15 +627,25 @@ var dbpath *string = flag.String("dbpath", "testdb", "config path")
 var dbmaxFileSize *int = flag.Int("fsz", 1024*1024*1024, "max file size")
 var dbMergeWindow *string = flag.String("window", "00_23", "bitcask merge window")
 var dbMergeTrigger *float64 = flag.Float64("trigger", 0.6, "bitcask merge trigger")
+var hashMethod *string = flag.String("hash", "crc32", "hash method of the master: fnv1a, fnv1a1, crc32 or md5")
+var hintPath *string = flag.String("hints", "", "where writes for unreachable replicas are kept (default dbpath-hints)")
+var hintSize *int = flag.Int("hintsize", 1024, "max MB of writes kept for an unreachable replica, the repairs make up for the others")
+var tombstoneGrace *int = flag.Int("grace", 24*7, "hours deleted keys are remembered, longer than a replica may be down")
+var namespaceSpec *string = flag.String("namespaces", "", "keys ns:... kept apart in dbpath-ns/ns, as ns[:fsz[:window[:trigger]]],...")
 
 type Config struct {
 	Options
+	Hash           string
+	HintPath       string        // dbpath-hints by default
+	TombstoneGrace time.Duration // before the merge drops a tombstone
+	Namespaces     []Namespace
 }
 
 func main() {
 	flag.Parse()
 
 	runtime.GOMAXPROCS(*threads)
+	hintMaxSize = int64(*hintSize) << 20
 
 	// config log
 	if *accesslog != "" {
@@ -168,7 +666,13 @@ func main() {
 		MaxFileSize:  int32(*dbmaxFileSize),
 		MergeWindow:  [2]int{st, et},
 		MergeTrigger: float32(*dbMergeTrigger),
-	}}
+	}, *hashMethod, *hintPath, time.Duration(*tombstoneGrace) * time.Hour, nil}
+	nss, err := parseNamespaces(*namespaceSpec, storeConf.Options)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	storeConf.Namespaces = nss
 	store := NewStore(storeConf)
 	defer store.Close()
 
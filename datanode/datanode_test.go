@@ -0,0 +1,254 @@
+package main
+
+import (
+	. "bitcask_go"
+	"caskdb/protocol"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+// newTestStore opens a store in a temporary directory.
+func newTestStore(t *testing.T) *BitcaskStore {
+	store := openTestStore(t, t.TempDir(), "")
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// openTestStore opens the store in dir with the namespaces of spec.
+func openTestStore(t *testing.T, dir, spec string) *BitcaskStore {
+	opts := Options{Path: dir + "/db"}
+	nss, err := parseNamespaces(spec, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(Config{Options: opts, Hash: "crc32", HintPath: dir + "/hints",
+		TombstoneGrace: time.Hour, Namespaces: nss})
+}
+
+func TestReclaimable(t *testing.T) {
+	store := newTestStore(t)
+	old := uint64(time.Now().Add(-2 * time.Hour).UnixNano())
+	recent := protocol.NewCas()
+	store.Reclaim(recent, protocol.Keyspace{})
+	for _, c := range []struct {
+		item *protocol.Item
+		ok   bool
+	}{
+		{&protocol.Item{Body: []byte("v"), Cas: old}, false},
+		{&protocol.Item{Body: []byte("v"), Cas: old, Exptime: 1}, true},
+		{&protocol.Item{Cas: old, Deleted: true}, true},
+		{&protocol.Item{Cas: recent, Deleted: true}, false},
+	} {
+		if ok := store.reclaimable("key", c.item); ok != c.ok {
+			t.Errorf("reclaimable %+v: %v", c.item, ok)
+		}
+	}
+
+	// a repair started before the delete does not let it go
+	store = newTestStore(t)
+	store.Reclaim(old-1, protocol.Keyspace{})
+	if store.reclaimable("key", &protocol.Item{Cas: old, Deleted: true}) {
+		t.Error("reclaimable before a repair covered the tombstone")
+	}
+	store.Reclaim(old+1, protocol.Keyspace{})
+	store.Reclaim(old-1, protocol.Keyspace{})
+	if !store.reclaimable("key", &protocol.Item{Cas: old, Deleted: true}) {
+		t.Error("not reclaimable after a repair covered the tombstone")
+	}
+}
+
+func TestReclaimKeys(t *testing.T) {
+	store := newTestStore(t)
+	old := uint64(time.Now().Add(-2 * time.Hour).UnixNano())
+	store.Set("live", &protocol.Item{Body: []byte("v")}, false)
+	store.Set("expired", &protocol.Item{Body: []byte("v"), Exptime: 1}, false)
+	store.DeleteCopy("deleted", old)
+
+	if n, m := store.reclaimKeys(store.bc.def); n != 1 || m != 0 {
+		t.Errorf("reclaimed %d expired items and %d tombstones before a repair", n, m)
+	}
+	if store.stored("deleted") == nil {
+		t.Fatal("tombstone dropped before a repair")
+	}
+
+	store.Reclaim(protocol.NewCas(), protocol.Keyspace{})
+	if n, m := store.reclaimKeys(store.bc.def); n != 0 || m != 1 {
+		t.Errorf("reclaimed %d expired items and %d tombstones", n, m)
+	}
+	if store.stored("deleted") != nil || store.stored("expired") != nil {
+		t.Error("reclaimable keys kept")
+	}
+	if item, _ := store.Get("live"); item == nil {
+		t.Error("live key reclaimed")
+	}
+}
+
+func TestSetCopy(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("key", &protocol.Item{Body: []byte("new"), Cas: 20}, false)
+	store.Set("key", &protocol.Item{Body: []byte("old"), Cas: 10}, false)
+	if item, _ := store.Get("key"); item == nil || string(item.Body) != "new" || item.Cas != 20 {
+		t.Errorf("older copy stored: %+v", item)
+	}
+	store.Set("key", &protocol.Item{Body: []byte("newer"), Cas: 30}, false)
+	if item, _ := store.Get("key"); item == nil || string(item.Body) != "newer" {
+		t.Errorf("newer copy dropped: %+v", item)
+	}
+	// a write of a client always makes a newer version
+	store.Set("key", &protocol.Item{Body: []byte("client")}, false)
+	if item, _ := store.Get("key"); item == nil || string(item.Body) != "client" || item.Cas <= 30 {
+		t.Errorf("write lost: %+v", item)
+	}
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("key", &protocol.Item{Body: []byte("v"), Cas: 10}, false)
+	if ok, err := store.Delete("key"); !ok || err != nil {
+		t.Fatalf("delete: %v %v", ok, err)
+	}
+	if ok, _ := store.Delete("key"); ok {
+		t.Error("deleted twice")
+	}
+	tomb := store.stored("key")
+	if tomb == nil || !tomb.Deleted || tomb.Cas <= 10 {
+		t.Fatalf("no tombstone: %+v", tomb)
+	}
+	// the older copy of a replica, a hint or a repair
+	store.Set("key", &protocol.Item{Body: []byte("v"), Cas: 10}, false)
+	if item, _ := store.Get("key"); item != nil {
+		t.Errorf("deleted key back: %+v", item)
+	}
+	if ok, _ := store.Add("key", &protocol.Item{Body: []byte("added")}, false); !ok {
+		t.Error("add over a tombstone")
+	}
+	if item, _ := store.Get("key"); item == nil || string(item.Body) != "added" {
+		t.Errorf("add lost: %+v", item)
+	}
+
+	// the copy of a tombstone deletes older versions only
+	store.DeleteCopy("key", tomb.Cas)
+	if item, _ := store.Get("key"); item == nil {
+		t.Error("older tombstone deleted a newer version")
+	}
+	store.DeleteCopy("key", protocol.NewCas())
+	if item, _ := store.Get("key"); item != nil {
+		t.Errorf("tombstone copy dropped: %+v", item)
+	}
+	store.DeleteCopy("missing", 5)
+	if item := store.stored("missing"); item == nil || !item.Deleted || item.Cas != 5 {
+		t.Errorf("tombstone of a missing key: %+v", item)
+	}
+}
+
+func TestScan(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 25; i++ {
+		store.Set(fmt.Sprintf("a%02d", i), &protocol.Item{Body: []byte("v")}, false)
+		store.Set(fmt.Sprintf("b%02d", i), &protocol.Item{Body: []byte("v")}, false)
+	}
+	store.Delete("a03")
+	store.Set("a04", &protocol.Item{Body: []byte("v"), Exptime: 1}, false)
+
+	var all []string
+	cursor := ""
+	for i := 0; i < 10; i++ {
+		keys, next, err := store.Scan(cursor, "a", 10)
+		if err != nil || len(keys) > 10 {
+			t.Fatalf("page %d: %v %v", i, keys, err)
+		}
+		all = append(all, keys...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(all) != 23 || !sort.StringsAreSorted(all) {
+		t.Fatalf("scanned %v", all)
+	}
+	for i, key := range all {
+		if key[0] != 'a' || key == "a03" || key == "a04" || (i > 0 && key == all[i-1]) {
+			t.Errorf("scanned %s", key)
+		}
+	}
+
+	// a new scan sees the keys written since
+	store.Set("a99", &protocol.Item{Body: []byte("v")}, false)
+	if keys, _, _ := store.Scan("", "a9", 10); len(keys) != 1 || keys[0] != "a99" {
+		t.Errorf("new key not scanned: %v", keys)
+	}
+}
+
+// The server finds the commands of the master by type assertion, a method
+// out of step with protocol turns them into "not supported".
+func TestStoreCommands(t *testing.T) {
+	var store protocol.Storage = newTestStore(t)
+	_, tombstoner := store.(protocol.Tombstoner)
+	_, replicator := store.(protocol.Replicator)
+	_, migrator := store.(protocol.Migrator)
+	_, prefixDeleter := store.(protocol.PrefixDeleter)
+	_, merkler := store.(protocol.Merkler)
+	_, reclaimer := store.(protocol.Reclaimer)
+	_, scanner := store.(protocol.Scanner)
+	_, ringer := store.(protocol.Ringer)
+	_, copier := store.(protocol.Copier)
+	if !tombstoner || !replicator || !migrator || !prefixDeleter || !merkler || !reclaimer || !scanner || !ringer || !copier {
+		t.Errorf("commands missing: %v %v %v %v %v %v %v %v %v", tombstoner, replicator, migrator,
+			prefixDeleter, merkler, reclaimer, scanner, ringer, copier)
+	}
+}
+
+func TestSetRingHash(t *testing.T) {
+	store := newTestStore(t)
+	if _, err := store.SetRing(1, "a:1 1 1 md5 a:1,b:1"); err == nil {
+		t.Error("ring of another hash method kept")
+	}
+	if epoch, err := store.SetRing(2, "a:1 1 1 crc32 a:1,b:1"); err != nil || epoch != 2 {
+		t.Errorf("ring refused: %d %v", epoch, err)
+	}
+}
+
+func TestCopies(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("live", &protocol.Item{Body: []byte("v"), Exptime: 2000000000}, false)
+	store.Set("expired", &protocol.Item{Body: []byte("v"), Exptime: protocol.MaxRelativeExptime + 1}, false)
+	store.DeleteCopy("deleted", 5)
+	items, err := store.Copies([]string{"live", "expired", "deleted", "missing"})
+	if err != nil || len(items) != 3 {
+		t.Fatalf("copies %v %v", items, err)
+	}
+	if item := items["live"]; item.Exptime != 2000000000 || item.Cas == 0 {
+		t.Errorf("live copy %+v", item)
+	}
+	if item := items["expired"]; !item.Expired() {
+		t.Errorf("expired copy %+v", item)
+	}
+	if item := items["deleted"]; !item.Deleted || item.Cas != 5 {
+		t.Errorf("tombstone %+v", item)
+	}
+}
+
+func TestMerkleExptime(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("key", &protocol.Item{Body: []byte("v"), Cas: 5}, false)
+	before, _ := store.Merkle(0, []int{0}, protocol.Keyspace{})
+	store.Set("key", &protocol.Item{Body: []byte("v"), Cas: 5, Exptime: 2000000000}, false)
+	after, _ := store.Merkle(0, []int{0}, protocol.Keyspace{})
+	if before[0] == after[0] {
+		t.Errorf("digest kept after the exptime changed")
+	}
+	leaves := make([]int, 1<<protocol.MerkleDepth)
+	for i := range leaves {
+		leaves[i] = i
+	}
+	keys, _ := store.MerkleKeys(leaves, protocol.Keyspace{})
+	if item := keys["key"]; item == nil || item.Cas != 5 || item.Exptime != 2000000000 {
+		t.Errorf("merkle keys %v", keys)
+	}
+	store.del("key")
+	if keys, _ := store.MerkleKeys(leaves, protocol.Keyspace{}); len(keys) != 0 {
+		t.Errorf("merkle keys after reclaim %v", keys)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Copies of writes are sent to every replica by a hintQueue. A copy is sent
+// at once while none waits for the replica, else, or when the send fails, it
+// is appended to the hint log, and synced, before the write is answered,
+//
+//	keylen(4) itemlen(4) crc32(4) key item
+//
+// the crc covering key and item. The appends waiting for a sync share it.
+// The log is replayed in batches sent in parallel, with backoff while the
+// replica is unreachable, and after a restart; the copies carry their cas,
+// so their order does not matter. The replay position is kept in a .pos file
+// next to the log, a batch is sent again if the node stops before saving it.
+// The log is cut at the first corrupt record.
+
+var hintMaxBackoff = time.Minute
+
+// the copies beyond it are dropped, for the repairs to make up
+var hintMaxSize int64 = 1 << 30
+
+const (
+	hintBatch   = 100 // records read at once by the replay
+	hintSenders = 10  // of a batch in parallel
+)
+
+var errHintsFull = errors.New("hint log full")
+
+type hint struct {
+	key  string
+	item *protocol.Item
+}
+
+type hintQueue struct {
+	sync.Mutex // appends to the log
+	target     *protocol.Host
+	path       string
+	log        *os.File
+	pos        int64 // offset of the first record not replayed
+	size       int64 // of the log
+	pending    int64 // records in the log not replayed yet
+	dropped    int64 // for a full log
+	full       bool
+	written    int64      // appends since the start
+	syncLock   sync.Mutex // of the group commits
+	synced     int64      // appends synced
+	wake       chan bool
+	stop, done chan bool // of the replay
+}
+
+func openHintQueue(dir string, target *protocol.Host) (*hintQueue, error) {
+	q := &hintQueue{target: target, path: filepath.Join(dir, target.Addr+".hint")}
+	q.wake = make(chan bool, 1)
+	q.stop, q.done = make(chan bool), make(chan bool)
+	var err error
+	if q.log, err = os.OpenFile(q.path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	if b, e := ioutil.ReadFile(q.path + ".pos"); e == nil {
+		q.pos, _ = strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+	}
+	if fi, e := q.log.Stat(); e != nil || q.pos > fi.Size() {
+		q.pos = 0
+	}
+
+	// count the records left, and drop the ones after a record cut by a
+	// crash or corrupt
+	end := q.pos
+	for {
+		_, n, e := readHint(q.log, end)
+		if e == io.EOF {
+			break
+		}
+		if e != nil {
+			log.Println("drop the hints for", target.Addr, "after", end, ":", e)
+			break
+		}
+		end += n
+		q.pending++
+	}
+	if err = q.log.Truncate(end); err != nil {
+		return nil, err
+	}
+	q.size = end
+	if _, err = q.log.Seek(end, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	if q.pending > 0 {
+		log.Println(q.pending, "hints to replay for", target.Addr)
+		q.wake <- true
+	}
+	go q.run()
+	return q, nil
+}
+
+const hintHeaderSize = 12
+
+var errBadHint = errors.New("corrupt hint")
+
+// readHint reads the record at pos, io.EOF tells that there is none.
+func readHint(f *os.File, pos int64) (*hint, int64, error) {
+	var head [hintHeaderSize]byte
+	if n, err := f.ReadAt(head[:], pos); err != nil {
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	klen := int64(binary.LittleEndian.Uint32(head[0:4]))
+	ilen := int64(binary.LittleEndian.Uint32(head[4:8]))
+	if klen > protocol.MaxKeyLength || ilen > protocol.MaxBodyLength+itemHeaderSize {
+		return nil, 0, errBadHint
+	}
+	v := make([]byte, klen+ilen)
+	if _, err := f.ReadAt(v, pos+hintHeaderSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(v) != binary.LittleEndian.Uint32(head[8:12]) {
+		return nil, 0, errBadHint
+	}
+	item, err := decodeItem(v[klen:])
+	if err != nil {
+		return nil, 0, err
+	}
+	return &hint{string(v[:klen]), item}, hintHeaderSize + klen + ilen, nil
+}
+
+// append writes h at the end of the log and syncs it, along with the
+// records appended meanwhile.
+func (q *hintQueue) append(h *hint) error {
+	v := encodeItem(h.item)
+	b := make([]byte, hintHeaderSize, hintHeaderSize+len(h.key)+len(v))
+	b = append(append(b, h.key...), v...)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(h.key)))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(len(v)))
+	binary.LittleEndian.PutUint32(b[8:12], crc32.ChecksumIEEE(b[hintHeaderSize:]))
+
+	q.Lock()
+	if q.size+int64(len(b)) > hintMaxSize {
+		if !q.full {
+			log.Println("hints for", q.target.Addr, "full, drop the copies until replayed")
+			q.full = true
+		}
+		q.dropped++
+		q.Unlock()
+		return errHintsFull
+	}
+	if _, err := q.log.Write(b); err != nil {
+		q.Unlock()
+		return err
+	}
+	q.size += int64(len(b))
+	q.written++
+	n := q.written
+	atomic.AddInt64(&q.pending, 1)
+	q.Unlock()
+
+	q.syncLock.Lock()
+	defer q.syncLock.Unlock()
+	if q.synced >= n {
+		return nil
+	}
+	q.Lock()
+	n = q.written
+	q.Unlock()
+	if err := q.log.Sync(); err != nil {
+		return err
+	}
+	q.synced = n
+	return nil
+}
+
+// push hands a copy of key to the replica, it is stored there or in the log
+// on return, unless the log is full.
+func (q *hintQueue) push(key string, item *protocol.Item) error {
+	h := &hint{key, item}
+	if atomic.LoadInt64(&q.pending) == 0 && q.send(h) {
+		return nil
+	}
+	if err := q.append(h); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- true:
+	default:
+	}
+	return nil
+}
+
+// send tells whether the replica stored h, a copy it refuses is dropped.
+func (q *hintQueue) send(h *hint) bool {
+	_, err := q.target.Set(h.key, h.item, false)
+	if err != nil && strings.HasPrefix(err.Error(), "CLIENT_ERROR") {
+		log.Println("drop hint", h.key, "for", q.target.Addr, ":", err)
+		return true
+	}
+	return err == nil
+}
+
+func (q *hintQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.wake:
+			q.replay()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// close stops the replay and closes the log.
+func (q *hintQueue) close() error {
+	close(q.stop)
+	<-q.done
+	q.Lock()
+	defer q.Unlock()
+	return q.log.Close()
+}
+
+func (q *hintQueue) stopped() bool {
+	select {
+	case <-q.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendAll sends hs in parallel, and returns the ones the replica did not
+// store.
+func (q *hintQueue) sendAll(hs []*hint) []*hint {
+	ok := make([]bool, len(hs))
+	senders := make(chan bool, hintSenders)
+	var wg sync.WaitGroup
+	for i, h := range hs {
+		wg.Add(1)
+		senders <- true
+		go func(i int, h *hint) {
+			defer wg.Done()
+			ok[i] = q.send(h)
+			<-senders
+		}(i, h)
+	}
+	wg.Wait()
+	var left []*hint
+	for i, h := range hs {
+		if !ok[i] {
+			left = append(left, h)
+		}
+	}
+	return left
+}
+
+// replay sends the records of the log by batches until it is empty,
+// waiting longer after every failure. A record which can not be read drops
+// the rest of the log, which can not be told apart from it.
+func (q *hintQueue) replay() {
+	backoff := time.Second
+	for atomic.LoadInt64(&q.pending) > 0 && !q.stopped() {
+		var hs []*hint
+		var size int64
+		for n := atomic.LoadInt64(&q.pending); int64(len(hs)) < n && len(hs) < hintBatch; {
+			h, m, err := readHint(q.log, q.pos+size)
+			if err != nil {
+				if len(hs) > 0 {
+					break // dropped with the next batch
+				}
+				log.Println("read hint for", q.target.Addr, "failed, drop", atomic.LoadInt64(&q.pending), "hints:", err)
+				q.Lock()
+				atomic.StoreInt64(&q.pending, 0)
+				q.reset()
+				q.Unlock()
+				return
+			}
+			hs = append(hs, h)
+			size += m
+		}
+		for left := hs; ; {
+			if left = q.sendAll(left); len(left) == 0 {
+				break
+			}
+			select {
+			case <-time.After(backoff):
+			case <-q.stop:
+				return
+			}
+			if backoff *= 2; backoff > hintMaxBackoff {
+				backoff = hintMaxBackoff
+			}
+		}
+		backoff = time.Second
+
+		q.Lock()
+		q.pos += size
+		if atomic.AddInt64(&q.pending, -int64(len(hs))) == 0 {
+			q.reset()
+		} else {
+			q.savePos()
+		}
+		q.Unlock()
+	}
+}
+
+// reset empties the log once all records are replayed, a crash in between
+// replays them again.
+func (q *hintQueue) reset() {
+	end := q.pos
+	q.pos = 0
+	q.savePos()
+	if err := q.log.Truncate(0); err != nil {
+		log.Println("truncate hints for", q.target.Addr, "failed:", err)
+		q.pos = end
+		q.savePos()
+		return
+	}
+	q.log.Seek(0, os.SEEK_SET)
+	q.size = 0
+	if q.full {
+		log.Println("hints for", q.target.Addr, "replayed,", q.dropped, "copies dropped while full")
+		q.full = false
+	}
+}
+
+func (q *hintQueue) savePos() {
+	err := ioutil.WriteFile(q.path+".pos", []byte(strconv.FormatInt(q.pos, 10)), 0644)
+	if err != nil {
+		log.Println("save hint position for", q.target.Addr, "failed:", err)
+	}
+}
+
+// hintQueue returns the queue of the replica addr, opening its log once.
+// The ring is checked with hintsLock held, so that dropHints closes a queue
+// opened for a replica of the ring it replaces.
+func (self *BitcaskStore) hintQueue(addr string) (*hintQueue, error) {
+	self.hintsLock.Lock()
+	defer self.hintsLock.Unlock()
+	if q, ok := self.hints[addr]; ok {
+		return q, nil
+	}
+	if err := self.checkPeer(addr); err != nil {
+		return nil, err
+	}
+	q, err := openHintQueue(self.hintDir, self.getHost(addr))
+	if err != nil {
+		return nil, err
+	}
+	self.hints[addr] = q
+	return q, nil
+}
+
+// closeHints stops the replays, which resume at the next start.
+func (self *BitcaskStore) closeHints() {
+	self.hintsLock.Lock()
+	defer self.hintsLock.Unlock()
+	for addr, q := range self.hints {
+		if err := q.close(); err != nil {
+			log.Println("close hints for", addr, "failed:", err)
+		}
+		delete(self.hints, addr)
+	}
+}
+
+// dropHints closes the queues of the replicas out of ring s and removes
+// their logs, the repairs of the ring make up for them.
+func (self *BitcaskStore) dropHints(s *protocol.RingSpec) {
+	self.hintsLock.Lock()
+	defer self.hintsLock.Unlock()
+	for addr, q := range self.hints {
+		if inRing(s, addr) {
+			continue
+		}
+		n := atomic.LoadInt64(&q.pending)
+		if err := q.close(); err != nil {
+			log.Println("close hints for", addr, "failed:", err)
+		}
+		os.Remove(q.path)
+		os.Remove(q.path + ".pos")
+		delete(self.hints, addr)
+		log.Println("drop", n, "hints for", addr, "out of the ring")
+	}
+}
+
+// openHints resumes the replay of the logs left by the last run.
+func (self *BitcaskStore) openHints() error {
+	if err := os.MkdirAll(self.hintDir, 0755); err != nil {
+		return err
+	}
+	paths, err := filepath.Glob(filepath.Join(self.hintDir, "*.hint"))
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		addr := strings.TrimSuffix(filepath.Base(p), ".hint")
+		if err := self.checkPeer(addr); err != nil {
+			log.Println("skip hints", p, ":", err)
+			continue
+		}
+		if _, err := self.hintQueue(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stats reports the copies waiting for the replicas, and the keys of the
+// namespaces.
+func (self *BitcaskStore) Stats() map[string]int64 {
+	self.hintsLock.Lock()
+	defer self.hintsLock.Unlock()
+	var n, dropped int64
+	for _, q := range self.hints {
+		n += atomic.LoadInt64(&q.pending)
+		q.Lock()
+		dropped += q.dropped
+		q.Unlock()
+	}
+	st := self.bc.Stats()
+	st["hints_pending"] = n
+	st["hints_dropped"] = dropped
+	return st
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// freeAddr returns an address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// serve serves store at addr, a free one from freeAddr.
+func serve(t *testing.T, addr string, store protocol.Storage) {
+	server := protocol.NewServer(store)
+	if err := server.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+}
+
+func TestHintReplayAfterRestart(t *testing.T) {
+	dir, addr := t.TempDir(), freeAddr(t)
+	q, err := openHintQueue(dir, protocol.NewHost(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than a batch
+	n := 2*hintBatch + 3
+	for i := 0; i < n; i++ {
+		if err := q.push(fmt.Sprintf("key%d", i), &protocol.Item{Body: []byte("v"), Cas: uint64(i + 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.close()
+
+	store := protocol.NewMapStore()
+	serve(t, addr, store)
+	q, err = openHintQueue(dir, protocol.NewHost(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	for i := 0; i < 100 && atomic.LoadInt64(&q.pending) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	for i := 0; i < n; i++ {
+		if item, _ := store.Get(fmt.Sprintf("key%d", i)); item == nil {
+			t.Errorf("key%d not replayed", i)
+		}
+	}
+	if fi, err := os.Stat(q.path); err != nil || fi.Size() != 0 {
+		t.Errorf("log not emptied: %v %v", fi, err)
+	}
+}
+
+func TestHintCorruptTail(t *testing.T) {
+	dir, addr := t.TempDir(), freeAddr(t)
+	q, err := openHintQueue(dir, protocol.NewHost(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push("key0", &protocol.Item{Body: []byte("v0"), Cas: 1})
+	q.push("key1", &protocol.Item{Body: []byte("v1"), Cas: 2})
+	q.close()
+	path := filepath.Join(dir, addr+".hint")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := hintHeaderSize + len("key0") + len(encodeItem(&protocol.Item{Body: []byte("v0")}))
+
+	reopen := func(log []byte, pending int64, size int) {
+		if err := ioutil.WriteFile(path, log, 0644); err != nil {
+			t.Fatal(err)
+		}
+		q, err := openHintQueue(dir, protocol.NewHost(addr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer q.close()
+		if n := atomic.LoadInt64(&q.pending); n != pending {
+			t.Errorf("%d hints pending, expect %d", n, pending)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Size() != int64(size) {
+			t.Errorf("log of %v bytes, expect %d: %v", fi.Size(), size, err)
+		}
+	}
+	// a record cut by a crash
+	reopen(append(append([]byte{}, b...), 1, 2, 3), 2, len(b))
+	// the last record damaged
+	bad := append([]byte{}, b...)
+	bad[len(bad)-1] ^= 0xff
+	reopen(bad, 1, first)
+}
+
+func TestHintDirectSend(t *testing.T) {
+	dir, addr := t.TempDir(), freeAddr(t)
+	store := protocol.NewMapStore()
+	serve(t, addr, store)
+	q, err := openHintQueue(dir, protocol.NewHost(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	if err := q.push("key", &protocol.Item{Body: []byte("v"), Cas: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if item, _ := store.Get("key"); item == nil {
+		t.Errorf("key not sent")
+	}
+	if fi, err := os.Stat(q.path); err != nil || fi.Size() != 0 || atomic.LoadInt64(&q.pending) != 0 {
+		t.Errorf("copy sent logged: %v %v", fi, err)
+	}
+}
+
+func TestHintMaxSize(t *testing.T) {
+	defer func(n int64) { hintMaxSize = n }(hintMaxSize)
+	hintMaxSize = 100
+	q, err := openHintQueue(t.TempDir(), protocol.NewHost(freeAddr(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.close()
+	item := &protocol.Item{Body: []byte("0123456789"), Cas: 1}
+	for i := 0; i < 3; i++ {
+		q.push(fmt.Sprintf("key%d", i), item)
+	}
+	if err := q.push("key3", item); err != errHintsFull {
+		t.Errorf("push to a full log: %v", err)
+	}
+	if fi, err := os.Stat(q.path); err != nil || fi.Size() > hintMaxSize || q.dropped == 0 {
+		t.Errorf("log of %v bytes, %d dropped: %v", fi.Size(), q.dropped, err)
+	}
+}
+
+func TestDropHints(t *testing.T) {
+	store := newTestStore(t)
+	gone, kept := freeAddr(t), freeAddr(t)
+	store.Set("key", &protocol.Item{Body: []byte("v")}, false)
+	store.Replicate("key", []string{gone, kept})
+	if _, err := store.SetRing(1, fmt.Sprintf("%s 1 1 crc32 %s", kept, kept)); err != nil {
+		t.Fatal(err)
+	}
+	if st := store.Stats(); st["hints_pending"] != 1 {
+		t.Errorf("hints pending %d", st["hints_pending"])
+	}
+	if _, err := os.Stat(filepath.Join(store.hintDir, gone+".hint")); !os.IsNotExist(err) {
+		t.Errorf("log of %s kept: %v", gone, err)
+	}
+}
+
+func TestHintPeers(t *testing.T) {
+	store := newTestStore(t)
+	member, other := freeAddr(t), freeAddr(t)
+	for _, addr := range []string{"../../x:1", "host", "host:port", ":11211", "a/b:1"} {
+		if _, err := store.hintQueue(addr); err == nil {
+			t.Errorf("hints for %q", addr)
+		}
+	}
+	if _, err := store.hintQueue(other); err != nil {
+		t.Errorf("hints for %s before a ring: %v", other, err)
+	}
+	if _, err := store.SetRing(1, fmt.Sprintf("%s 1 1 crc32 %s", member, member)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.hintQueue(other); err == nil {
+		t.Errorf("hints for %s out of the ring", other)
+	}
+	if _, err := store.hintQueue(member); err != nil {
+		t.Errorf("hints for %s: %v", member, err)
+	}
+	if paths, _ := filepath.Glob(filepath.Join(store.hintDir, "*.hint")); len(paths) != 1 {
+		t.Errorf("hint logs %v", paths)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"sort"
+	"sync"
+)
+
+// keyIndex holds the version of every stored key by leaf of the Merkle tree
+// and the keys in order, so that merkle_keys and scans read no value.
+type keyIndex struct {
+	sync.Mutex
+	hash   protocol.HashMethod
+	leaves map[uint32]map[string]keyMeta
+	sorted [][]string // chunks in order, of up to 2*indexChunk keys
+}
+
+type keyMeta struct {
+	cas     uint64
+	exptime int
+	deleted bool
+}
+
+// a chunk is split in two halves beyond twice that
+const indexChunk = 512
+
+func newKeyIndex(hash protocol.HashMethod) *keyIndex {
+	return &keyIndex{hash: hash, leaves: make(map[uint32]map[string]keyMeta)}
+}
+
+func (m keyMeta) item() *protocol.Item {
+	return &protocol.Item{Cas: m.cas, Exptime: m.exptime, Deleted: m.deleted}
+}
+
+func (m keyMeta) live() bool {
+	return !m.deleted && !m.item().Expired()
+}
+
+func (ix *keyIndex) leafOf(key string) uint32 {
+	return ix.hash([]byte(key)) >> (32 - protocol.MerkleDepth)
+}
+
+// put records item as the version of key, nil for none.
+func (ix *keyIndex) put(key string, item *protocol.Item) {
+	ix.Lock()
+	defer ix.Unlock()
+	leaf := ix.leafOf(key)
+	keys := ix.leaves[leaf]
+	if item == nil {
+		if _, ok := keys[key]; ok {
+			delete(keys, key)
+			if len(keys) == 0 {
+				delete(ix.leaves, leaf)
+			}
+			ix.remove(key)
+		}
+		return
+	}
+	if keys == nil {
+		keys = make(map[string]keyMeta)
+		ix.leaves[leaf] = keys
+	}
+	if _, ok := keys[key]; !ok {
+		ix.insert(key)
+	}
+	keys[key] = keyMeta{item.Cas, item.Exptime, item.Deleted}
+}
+
+// find returns the chunk key sorts in and its place there.
+func (ix *keyIndex) find(key string) (int, int) {
+	c := sort.Search(len(ix.sorted), func(i int) bool {
+		chunk := ix.sorted[i]
+		return chunk[len(chunk)-1] >= key
+	})
+	if c == len(ix.sorted) {
+		c--
+	}
+	return c, sort.SearchStrings(ix.sorted[c], key)
+}
+
+func (ix *keyIndex) insert(key string) {
+	if len(ix.sorted) == 0 {
+		ix.sorted = [][]string{{key}}
+		return
+	}
+	c, i := ix.find(key)
+	chunk := append(ix.sorted[c], "")
+	copy(chunk[i+1:], chunk[i:])
+	chunk[i] = key
+	if len(chunk) <= 2*indexChunk {
+		ix.sorted[c] = chunk
+		return
+	}
+	half := append([]string(nil), chunk[indexChunk:]...)
+	ix.sorted = append(ix.sorted, nil)
+	copy(ix.sorted[c+2:], ix.sorted[c+1:])
+	ix.sorted[c], ix.sorted[c+1] = chunk[:indexChunk:indexChunk], half
+}
+
+func (ix *keyIndex) remove(key string) {
+	c, i := ix.find(key)
+	chunk := ix.sorted[c]
+	if i == len(chunk) || chunk[i] != key {
+		return
+	}
+	if len(chunk) == 1 {
+		ix.sorted = append(ix.sorted[:c], ix.sorted[c+1:]...)
+		return
+	}
+	ix.sorted[c] = append(chunk[:i], chunk[i+1:]...)
+}
+
+// scan calls f on the keys from start on in order, with their version,
+// until f returns false.
+func (ix *keyIndex) scan(start string, f func(key string, m keyMeta) bool) {
+	ix.Lock()
+	defer ix.Unlock()
+	if len(ix.sorted) == 0 {
+		return
+	}
+	c, i := ix.find(start)
+	for ; c < len(ix.sorted); c, i = c+1, 0 {
+		for _, key := range ix.sorted[c][i:] {
+			if !f(key, ix.leaves[ix.leafOf(key)][key]) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestKeyIndex(t *testing.T) {
+	ix := newKeyIndex(protocol.HashMethods["fnv1a"])
+	n := 5 * indexChunk
+	for _, i := range rand.Perm(n) {
+		ix.put(fmt.Sprintf("k%05d", i), &protocol.Item{Cas: uint64(i + 1)})
+	}
+	// drop the odd keys and tombstone every tenth
+	for i := 1; i < n; i += 2 {
+		ix.put(fmt.Sprintf("k%05d", i), nil)
+	}
+	for i := 0; i < n; i += 10 {
+		ix.put(fmt.Sprintf("k%05d", i), &protocol.Item{Cas: uint64(n + i), Deleted: true})
+	}
+	if len(ix.sorted) < 2 {
+		t.Fatalf("%d chunks", len(ix.sorted))
+	}
+
+	var keys []string
+	ix.scan("k00100", func(key string, m keyMeta) bool {
+		if m.live() {
+			keys = append(keys, key)
+		}
+		return len(keys) < 500
+	})
+	i := 102
+	for _, key := range keys {
+		if i%10 == 0 {
+			i += 2
+		}
+		if key != fmt.Sprintf("k%05d", i) {
+			t.Fatalf("got %s, expect k%05d", key, i)
+		}
+		i += 2
+	}
+	if len(keys) != 500 {
+		t.Errorf("scanned %d keys", len(keys))
+	}
+	if rs, _ := (&BitcaskStore{keys: ix}).MerkleKeys([]int{int(ix.leafOf("k00010"))}, protocol.Keyspace{}); rs["k00010"] == nil || !rs["k00010"].Deleted {
+		t.Errorf("merkle keys %v", rs)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"encoding/binary"
+	"errors"
+)
+
+// Items are stored in bitcask as a header followed by the body:
+//
+//	magic(3) version(1) kind(1) flag(4) exptime(8) cas(8) body
+//
+// A tombstone is of kind itemTombstone and has no body. The values written
+// before the header existed are bare bodies, they are read as items without
+// flag, exptime nor cas, which lose to any copy of the key.
+const itemHeaderSize = 25
+
+var itemMagic = [3]byte{0xca, 0x5c, 0xdb}
+
+const itemVersion = 1
+
+const (
+	itemValue     = 0
+	itemTombstone = 1
+)
+
+func encodeItem(item *protocol.Item) []byte {
+	v := make([]byte, itemHeaderSize+len(item.Body))
+	copy(v[0:3], itemMagic[:])
+	v[3] = itemVersion
+	if item.Deleted {
+		v[4] = itemTombstone
+	}
+	binary.LittleEndian.PutUint32(v[5:9], uint32(item.Flag))
+	binary.LittleEndian.PutUint64(v[9:17], uint64(int64(item.Exptime)))
+	binary.LittleEndian.PutUint64(v[17:25], item.Cas)
+	copy(v[itemHeaderSize:], item.Body)
+	return v
+}
+
+func decodeItem(v []byte) (*protocol.Item, error) {
+	if len(v) < itemHeaderSize || v[0] != itemMagic[0] || v[1] != itemMagic[1] || v[2] != itemMagic[2] {
+		return &protocol.Item{Body: v}, nil
+	}
+	if v[3] != itemVersion || v[4] > itemTombstone {
+		return nil, errors.New("unknown item version")
+	}
+	item := &protocol.Item{}
+	item.Deleted = v[4] == itemTombstone
+	item.Flag = int(binary.LittleEndian.Uint32(v[5:9]))
+	item.Exptime = int(int64(binary.LittleEndian.Uint64(v[9:17])))
+	item.Cas = binary.LittleEndian.Uint64(v[17:25])
+	item.Body = v[itemHeaderSize:]
+	return item, nil
+}
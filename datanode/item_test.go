@@ -0,0 +1,36 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"testing"
+)
+
+func TestEncodeItem(t *testing.T) {
+	for _, item := range []*protocol.Item{
+		{Body: []byte("value"), Flag: 3, Exptime: 1234567890, Cas: 42},
+		{Body: []byte{}, Exptime: -1},
+		{Cas: 7, Deleted: true},
+	} {
+		r, err := decodeItem(encodeItem(item))
+		if err != nil || string(r.Body) != string(item.Body) || r.Flag != item.Flag ||
+			r.Exptime != item.Exptime || r.Cas != item.Cas || r.Deleted != item.Deleted {
+			t.Errorf("decode %+v got %+v %v", item, r, err)
+		}
+	}
+}
+
+// The values of a bitcask written before the header are bare bodies.
+func TestDecodeOldItem(t *testing.T) {
+	for _, body := range []string{"", "short", "a value longer than the header of an item"} {
+		r, err := decodeItem([]byte(body))
+		if err != nil || string(r.Body) != body || r.Cas != 0 || r.Deleted || r.Expired() {
+			t.Errorf("decode old %q got %+v %v", body, r, err)
+		}
+	}
+
+	v := encodeItem(&protocol.Item{Body: []byte("v")})
+	v[3] = itemVersion + 1
+	if _, err := decodeItem(v); err == nil {
+		t.Error("decode an unknown version")
+	}
+}
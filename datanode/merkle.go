@@ -0,0 +1,151 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+)
+
+// merkleTree covers the ring of the master with a complete binary tree,
+// level l has 1<<l nodes and the leaves are at protocol.MerkleDepth. Every
+// node is the xor of the digests of the keys hashed under it, so that a
+// write only updates the path from its leaf to the root.
+type merkleTree struct {
+	sync.Mutex
+	nodes [][]uint64
+}
+
+func newMerkleTree() *merkleTree {
+	t := new(merkleTree)
+	t.nodes = make([][]uint64, protocol.MerkleDepth+1)
+	for l := range t.nodes {
+		t.nodes[l] = make([]uint64, 1<<uint(l))
+	}
+	return t
+}
+
+// keyDigest covers the exptime as well, so that a copy which lost it differs.
+func keyDigest(key string, item *protocol.Item) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	var b [12]byte
+	binary.LittleEndian.PutUint64(b[:8], item.Cas)
+	binary.LittleEndian.PutUint32(b[8:], uint32(item.Exptime))
+	h.Write(b[:])
+	return h.Sum64()
+}
+
+// toggle adds or removes the digest d of a key at ring position pos.
+func (t *merkleTree) toggle(pos uint32, d uint64) {
+	t.Lock()
+	defer t.Unlock()
+	for l := range t.nodes {
+		t.nodes[l][pos>>uint(32-l)] ^= d
+	}
+}
+
+func (t *merkleTree) get(level int, nodes []int) ([]uint64, error) {
+	if level < 0 || level > protocol.MerkleDepth {
+		return nil, errors.New("invalid level")
+	}
+	t.Lock()
+	defer t.Unlock()
+	ds := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		if n < 0 || n >= len(t.nodes[level]) {
+			return nil, errors.New("invalid node")
+		}
+		ds[i] = t.nodes[level][n]
+	}
+	return ds, nil
+}
+
+// stored returns the stored version of key, expired or not.
+func (self *BitcaskStore) stored(key string) *protocol.Item {
+	v, err := self.bc.Get(key)
+	if err != nil {
+		return nil
+	}
+	item, err := decodeItem(v)
+	if err != nil {
+		return nil
+	}
+	return item
+}
+
+// changed updates the trees after key moved from version old to item, nil
+// for a missing version.
+func (self *BitcaskStore) changed(key string, old, item *protocol.Item) {
+	self.keys.put(key, item)
+	if old != nil && item != nil && old.Cas == item.Cas && old.Exptime == item.Exptime {
+		return
+	}
+	pos := self.hash([]byte(key))
+	trees := []*merkleTree{self.tree}
+	if t := self.nsTrees[self.bc.nsOf(key)]; t != nil {
+		trees = append(trees, t)
+	}
+	for _, t := range trees {
+		if old != nil {
+			t.toggle(pos, keyDigest(key, old))
+		}
+		if item != nil {
+			t.toggle(pos, keyDigest(key, item))
+		}
+	}
+}
+
+// buildTree adds all stored keys to the trees and the index.
+func (self *BitcaskStore) buildTree() {
+	t := time.Now()
+	n := 0
+	for key := range self.bc.Keys() {
+		if item := self.stored(key); item != nil {
+			self.changed(key, nil, item)
+			n++
+		}
+	}
+	log.Println("merkle tree of", n, "keys built in", time.Since(t))
+}
+
+// Merkle answers from the tree of the namespace of ks, or from the tree of
+// all keys less the trees of the namespaces ks skips. The keys of a namespace
+// given without -namespaces are not told apart.
+func (self *BitcaskStore) Merkle(level int, nodes []int, ks protocol.Keyspace) ([]uint64, error) {
+	if t := self.nsTrees[ks.Only]; t != nil {
+		return t.get(level, nodes)
+	}
+	ds, err := self.tree.get(level, nodes)
+	if err != nil || ks.Only != "" {
+		return ds, err
+	}
+	for _, ns := range ks.Skip {
+		if t := self.nsTrees[ns]; t != nil {
+			skip, _ := t.get(level, nodes)
+			for i := range ds {
+				ds[i] ^= skip[i]
+			}
+		}
+	}
+	return ds, nil
+}
+
+// MerkleKeys returns the keys of ks under the leaves, tombstones included,
+// with their cas unique and exptime but no value.
+func (self *BitcaskStore) MerkleKeys(leaves []int, ks protocol.Keyspace) (map[string]*protocol.Item, error) {
+	self.keys.Lock()
+	defer self.keys.Unlock()
+	rs := make(map[string]*protocol.Item)
+	for _, n := range leaves {
+		for key, m := range self.keys.leaves[uint32(n)] {
+			if ks.Has(key) {
+				rs[key] = m.item()
+			}
+		}
+	}
+	return rs, nil
+}
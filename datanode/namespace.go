@@ -0,0 +1,282 @@
+package main
+
+import (
+	. "bitcask_go"
+	"caskdb/protocol"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// A key named "ns:..." belongs to the namespace ns when it is given with
+// -namespaces. Every namespace has a bitcask of its own, in dbpath-ns/ns,
+// with its own options, so that its merges and loads do not slow down the
+// others; the other keys stay in dbpath. Keys are stored as they are, the
+// copies between nodes do not know about namespaces. The keys of a namespace
+// written to dbpath before it was given are moved to its bitcask on open.
+
+// Namespace is name[:fsz[:window[:trigger]]] in -namespaces, the options
+// left out are the ones of dbpath.
+type Namespace struct {
+	Name string
+	Options
+}
+
+func validNamespace(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseNamespaces reads the namespaces of spec, "ns[:opts],...", with the
+// options of dbpath as defaults.
+func parseNamespaces(spec string, def Options) ([]Namespace, error) {
+	var nss []Namespace
+	if spec == "" {
+		return nss, nil
+	}
+	seen := make(map[string]bool)
+	for _, s := range strings.Split(spec, ",") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 4 || !validNamespace(parts[0]) || seen[parts[0]] {
+			return nil, errors.New("invalid namespace: " + s)
+		}
+		ns := Namespace{parts[0], def}
+		ns.Path = filepath.Join(def.Path+"-ns", ns.Name)
+		if len(parts) > 1 && parts[1] != "" {
+			n, e := strconv.ParseInt(parts[1], 10, 32)
+			if e != nil || n <= 0 {
+				return nil, errors.New("invalid file size of namespace: " + s)
+			}
+			ns.MaxFileSize = int32(n)
+		}
+		if len(parts) > 2 && parts[2] != "" {
+			var st, et int
+			if n, _ := fmt.Sscanf(parts[2], "%d_%d", &st, &et); n != 2 {
+				return nil, errors.New("invalid merge window of namespace: " + s)
+			}
+			ns.MergeWindow = [2]int{st, et}
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			f, e := strconv.ParseFloat(parts[3], 32)
+			if e != nil {
+				return nil, errors.New("invalid merge trigger of namespace: " + s)
+			}
+			ns.MergeTrigger = float32(f)
+		}
+		seen[ns.Name] = true
+		nss = append(nss, ns)
+	}
+	return nss, nil
+}
+
+// namespaces routes every key to the bitcask of its namespace.
+type namespaces struct {
+	def      *Bitcask
+	names    []string
+	bcs      map[string]*Bitcask
+	counters map[string]*nsCounters
+}
+
+// nsCounters counts the commands on the keys of a namespace.
+type nsCounters struct {
+	gets, hits, sets, deletes int64
+}
+
+func openNamespaces(def Options, nss []Namespace) (*namespaces, error) {
+	n := &namespaces{bcs: make(map[string]*Bitcask), counters: make(map[string]*nsCounters)}
+	var err error
+	if n.def, err = NewBitcask(def); err != nil {
+		return nil, fmt.Errorf("%s: %v", def.Path, err)
+	}
+	for _, ns := range nss {
+		if err = os.MkdirAll(filepath.Dir(ns.Path), 0755); err != nil {
+			n.Close()
+			return nil, err
+		}
+		bc, err := NewBitcask(ns.Options)
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("%s: %v", ns.Path, err)
+		}
+		n.names = append(n.names, ns.Name)
+		n.bcs[ns.Name] = bc
+		n.counters[ns.Name] = new(nsCounters)
+	}
+	if err = n.moveKeys(def.Path); err != nil {
+		n.Close()
+		return nil, err
+	}
+	return n, nil
+}
+
+// moveKeys moves the keys of the namespaces out of dbpath, the newer version
+// is kept when a key is in both.
+func (n *namespaces) moveKeys(path string) error {
+	var keys []string
+	for key := range n.def.Keys() {
+		if n.of(key) != n.def {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys {
+		v, err := n.def.Get(key)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		bc := n.of(key)
+		if old, e := bc.Get(key); e == nil && !newerValue(v, old) {
+			v = nil
+		}
+		if v != nil {
+			if err = bc.Set(key, v); err != nil {
+				return err
+			}
+		}
+		if err = n.def.Del(key); err != nil {
+			return err
+		}
+	}
+	if len(keys) > 0 {
+		n.Sync()
+		log.Println("moved", len(keys), "keys of namespaces out of", path)
+	}
+	return nil
+}
+
+// newerValue tells whether the stored value v is newer than old.
+func newerValue(v, old []byte) bool {
+	a, err := decodeItem(v)
+	if err != nil {
+		return false
+	}
+	b, err := decodeItem(old)
+	if err != nil {
+		return true
+	}
+	return protocol.Newer(a, b)
+}
+
+// nsOf returns the namespace of key, empty for the keys of dbpath.
+func (n *namespaces) nsOf(key string) string {
+	if i := strings.IndexByte(key, ':'); i > 0 {
+		if _, ok := n.bcs[key[:i]]; ok {
+			return key[:i]
+		}
+	}
+	return ""
+}
+
+func (n *namespaces) of(key string) *Bitcask {
+	if ns := n.nsOf(key); ns != "" {
+		return n.bcs[ns]
+	}
+	return n.def
+}
+
+// countGet, countSet and countDelete count a command on key in the stats of
+// its namespace.
+func (n *namespaces) countGet(key string, hit bool) {
+	if c := n.counters[n.nsOf(key)]; c != nil {
+		atomic.AddInt64(&c.gets, 1)
+		if hit {
+			atomic.AddInt64(&c.hits, 1)
+		}
+	}
+}
+
+func (n *namespaces) countSet(key string) {
+	if c := n.counters[n.nsOf(key)]; c != nil {
+		atomic.AddInt64(&c.sets, 1)
+	}
+}
+
+func (n *namespaces) countDelete(key string) {
+	if c := n.counters[n.nsOf(key)]; c != nil {
+		atomic.AddInt64(&c.deletes, 1)
+	}
+}
+
+func (n *namespaces) Get(key string) ([]byte, error) {
+	return n.of(key).Get(key)
+}
+
+func (n *namespaces) Set(key string, v []byte) error {
+	return n.of(key).Set(key, v)
+}
+
+func (n *namespaces) Del(key string) error {
+	return n.of(key).Del(key)
+}
+
+// Keys lists the keys of all namespaces, one after the other.
+func (n *namespaces) Keys() chan string {
+	ch := make(chan string, 1024)
+	go func() {
+		for key := range n.def.Keys() {
+			ch <- key
+		}
+		for _, name := range n.names {
+			for key := range n.bcs[name].Keys() {
+				ch <- key
+			}
+		}
+		close(ch)
+	}()
+	return ch
+}
+
+func (n *namespaces) Len() int64 {
+	l := n.def.Len()
+	for _, bc := range n.bcs {
+		l += bc.Len()
+	}
+	return l
+}
+
+func (n *namespaces) Sync() {
+	n.def.Sync()
+	for _, bc := range n.bcs {
+		bc.Sync()
+	}
+}
+
+func (n *namespaces) Close() error {
+	var err error
+	for _, bc := range n.bcs {
+		if e := bc.Close(); e != nil {
+			err = e
+		}
+	}
+	if n.def != nil {
+		if e := n.def.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Stats reports the keys and the commands of every namespace.
+func (n *namespaces) Stats() map[string]int64 {
+	st := make(map[string]int64, 5*len(n.bcs))
+	for name, bc := range n.bcs {
+		c := n.counters[name]
+		st["ns_"+name+"_items"] = bc.Len()
+		st["ns_"+name+"_cmd_get"] = atomic.LoadInt64(&c.gets)
+		st["ns_"+name+"_get_hits"] = atomic.LoadInt64(&c.hits)
+		st["ns_"+name+"_cmd_set"] = atomic.LoadInt64(&c.sets)
+		st["ns_"+name+"_cmd_delete"] = atomic.LoadInt64(&c.deletes)
+	}
+	return st
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	. "bitcask_go"
+	"caskdb/protocol"
+	"testing"
+	"time"
+)
+
+func TestMoveKeysOfNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	store := openTestStore(t, dir, "")
+	store.Set("s:1", &protocol.Item{Body: []byte("old"), Cas: 10}, false)
+	store.Set("s:2", &protocol.Item{Body: []byte("v"), Cas: 10}, false)
+	store.Set("x", &protocol.Item{Body: []byte("v")}, false)
+	store.Close()
+
+	store = openTestStore(t, dir, "s")
+	// a newer version in the namespace wins over the one left in dbpath
+	store.Set("s:1", &protocol.Item{Body: []byte("new"), Cas: 20}, false)
+	store.Close()
+	bc, err := NewBitcask(Options{Path: dir + "/db"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.Set("s:1", encodeItem(&protocol.Item{Body: []byte("old"), Cas: 10}))
+	bc.Close()
+
+	store = openTestStore(t, dir, "s")
+	defer store.Close()
+	for key, body := range map[string]string{"s:1": "new", "s:2": "v", "x": "v"} {
+		if item, _ := store.Get(key); item == nil || string(item.Body) != body {
+			t.Errorf("%s got %+v", key, item)
+		}
+	}
+	if _, err := store.bc.def.Get("s:2"); err == nil {
+		t.Error("s:2 left in dbpath")
+	}
+	if n := store.bc.bcs["s"].Len(); n != 2 {
+		t.Errorf("%d keys in namespace s", n)
+	}
+}
+
+func TestNamespaceStats(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), "s")
+	defer store.Close()
+	store.Set("s:1", &protocol.Item{Body: []byte("v")}, false)
+	store.Set("x", &protocol.Item{Body: []byte("v")}, false)
+	store.Get("s:1")
+	store.Get("s:2")
+	store.Get("x")
+	store.GetMulti([]string{"s:1", "x"})
+	store.Delete("s:1")
+
+	st := store.Stats()
+	for k, v := range map[string]int64{"ns_s_items": 1, "ns_s_cmd_get": 3, "ns_s_get_hits": 2,
+		"ns_s_cmd_set": 1, "ns_s_cmd_delete": 1} {
+		if st[k] != v {
+			t.Errorf("%s is %d, expect %d", k, st[k], v)
+		}
+	}
+}
+
+func TestKeyspaceOfNamespaces(t *testing.T) {
+	store := openTestStore(t, t.TempDir(), "s")
+	defer store.Close()
+	for _, key := range []string{"s:1", "s:2", "x", "y"} {
+		store.Set(key, &protocol.Item{Body: []byte("v")}, false)
+	}
+	all := protocol.Keyspace{}
+	main := protocol.Keyspace{Skip: []string{"s"}}
+	only := protocol.Keyspace{Only: "s"}
+
+	// the digests of the rings add up to the digest of all keys
+	root := func(ks protocol.Keyspace) uint64 {
+		ds, err := store.Merkle(0, []int{0}, ks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ds[0]
+	}
+	if root(main) == root(all) || root(main)^root(only) != root(all) {
+		t.Errorf("digests of all %d, main %d, s %d", root(all), root(main), root(only))
+	}
+	leaves := make([]int, 1<<protocol.MerkleDepth)
+	for i := range leaves {
+		leaves[i] = i
+	}
+	if keys, _ := store.MerkleKeys(leaves, only); len(keys) != 2 || keys["s:1"] == nil {
+		t.Errorf("merkle keys of s: %v", keys)
+	}
+
+	target, addr := protocol.NewMapStore(), freeAddr(t)
+	serve(t, addr, target)
+	var mst protocol.MigrateStatus
+	store.migrate(addr, 0, 0, main, &mst)
+	if mst.Copied != 2 || target.Len() != 2 {
+		t.Errorf("copied %d keys of the main ring: %+v", target.Len(), mst)
+	}
+
+	var st protocol.PrefixStatus
+	store.deletePrefix("", protocol.NewCas(), main, &st)
+	if st.Deleted != 2 {
+		t.Errorf("deleted %d keys of the main ring", st.Deleted)
+	}
+	if item, _ := store.Get("s:1"); item == nil {
+		t.Error("key of s deleted by the main ring")
+	}
+
+	// a repair of the ring of s covers the tombstones of s only
+	old := uint64(time.Now().Add(-2 * time.Hour).UnixNano())
+	store.DeleteCopy("s:3", old)
+	store.DeleteCopy("z", old)
+	store.Reclaim(protocol.NewCas(), only)
+	if !store.reclaimable("s:3", store.stored("s:3")) || store.reclaimable("z", store.stored("z")) {
+		t.Error("reclaim of s covers the wrong tombstones")
+	}
+}
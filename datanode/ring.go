@@ -0,0 +1,79 @@
+package main
+
+import (
+	"caskdb/protocol"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SetRing keeps the ring of epoch if it is newer than the one kept. A ring
+// hashed otherwise than -hash is refused: the migrations would copy other
+// keys than the master asks for, and the Merkle trees would not match the
+// ranges of the repairs.
+func (self *BitcaskStore) SetRing(epoch int64, spec string) (int64, error) {
+	s, err := protocol.ParseRingSpec(spec)
+	if err != nil {
+		return 0, err
+	}
+	if s.Opts.Hash != self.hashName {
+		err = fmt.Errorf("ring hashed with %s, run with -hash %s", s.Opts.Hash, s.Opts.Hash)
+		log.Println("ring", epoch, "refused:", err)
+		return 0, err
+	}
+	self.ringLock.Lock()
+	newer := epoch > self.epoch
+	if newer {
+		log.Println("ring", epoch, ":", spec)
+		self.ring = protocol.NewRingOwner(s)
+		self.epoch = epoch
+	}
+	cur := self.epoch
+	self.ringLock.Unlock()
+	if newer {
+		self.dropHints(s)
+	}
+	return cur, nil
+}
+
+// checkPeer tells why addr may not get the copies of the writes: it is not
+// a host:port, or not a server of the ring once the master pushed one.
+func (self *BitcaskStore) checkPeer(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if n, e := strconv.Atoi(port); err != nil || e != nil || host == "" || n < 1 || n > 65535 ||
+		strings.ContainsAny(host, `/\`) {
+		return fmt.Errorf("invalid replica %q", addr)
+	}
+	self.ringLock.Lock()
+	defer self.ringLock.Unlock()
+	if self.ring != nil && !inRing(self.ring.Spec, addr) {
+		return fmt.Errorf("replica %s out of the ring %d", addr, self.epoch)
+	}
+	return nil
+}
+
+// inRing tells whether addr is a server of s, or of the ring it migrates to.
+func inRing(s *protocol.RingSpec, addr string) bool {
+	for _, list := range [][]string{s.Servers, s.Target} {
+		for _, a := range list {
+			if a == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Owns accepts the writes routed with a ring at least as new as the one
+// kept, which may go to a stand-in for a replica which is down, and the
+// others for the keys this node replicates.
+func (self *BitcaskStore) Owns(key string, epoch int64) (int64, bool) {
+	self.ringLock.Lock()
+	defer self.ringLock.Unlock()
+	if self.ring == nil || epoch >= self.epoch {
+		return self.epoch, true
+	}
+	return self.epoch, self.ring.Owns(key)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	. "caskdb/protocol"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// The ring is kept in the state file, see StateFile, which several masters
+// may share. The leader starts a migration once the followers had the time
+// to send their writes to the new ring too.
+
+const (
+	clusterInterval = time.Second
+	leaseTime       = 5 * time.Second
+	retryInterval   = 10 * time.Second // between two migrations to the same members
+)
+
+var cluster *StateFile
+var isLeader int32
+
+// refresh follows the ring of the state file at once, after a server told
+// that it is newer than the ring of this master.
+func refresh() {
+	if leading() {
+		return
+	}
+	st, err := cluster.Load()
+	if err == nil && len(st.Ring) > 0 {
+		err = schd.Follow(st)
+	}
+	if err != nil {
+		log.Print("refresh the ring failed: ", err)
+	}
+}
+
+// leading tells whether this master drives the migrations, which is always
+// the case without a state file.
+func leading() bool {
+	return cluster == nil || atomic.LoadInt32(&isLeader) == 1
+}
+
+type clusterLoop struct {
+	id               string
+	prepared, tried  time.Time // target published, last migration started
+	started, leading bool
+}
+
+// run keeps the ring of this master in line with the state file.
+func (l *clusterLoop) run() {
+	for {
+		time.Sleep(clusterInterval)
+		l.tick()
+	}
+}
+
+func (l *clusterLoop) tick() {
+	st, leader, err := cluster.Campaign(l.id, leaseTime)
+	if err != nil {
+		log.Print("campaign failed: ", err)
+		return
+	}
+	var v int32
+	if leader {
+		v = 1
+	}
+	atomic.StoreInt32(&isLeader, v)
+	wasLeader := l.leading
+	l.leading = leader
+	if !leader {
+		l.prepared = time.Time{}
+		if len(st.Ring) > 0 {
+			if e := schd.Follow(st); e != nil {
+				log.Print("follow the ring failed: ", e)
+			}
+		}
+		return
+	}
+
+	members := st.Members
+	if len(members) == 0 {
+		members = ringServers
+		if e := cluster.SetMembers(members); e != nil {
+			log.Print("set members failed: ", e)
+		}
+	}
+	if !wasLeader && len(st.Ring) > 0 {
+		log.Println(l.id, "leads the cluster, ring version", st.Version)
+		l.takeOver(st, members)
+	}
+
+	target := schd.Target()
+	switch {
+	case schd.Migrating():
+	case SameAddrs(schd.Servers(), members):
+		l.prepared = time.Time{}
+	case l.prepared.IsZero():
+		if time.Since(l.tried) > retryInterval {
+			target = members
+			l.prepared = time.Now()
+		}
+	case time.Since(l.prepared) < 2*clusterInterval:
+		target = members
+	default:
+		if e := client.UpdateServers(members); e != nil {
+			log.Print("update servers failed: ", e)
+		}
+		target = schd.Target()
+		l.prepared = time.Time{}
+		l.tried = time.Now()
+	}
+	st, err = cluster.Publish(l.id, schd.Servers(), target, schd.Migration())
+	if err != nil {
+		log.Print("publish the ring failed: ", err)
+		return
+	}
+	schd.SetEpoch(st)
+}
+
+// takeOver starts from the ring of the state file. A migration which was
+// interrupted, by a restart or by the end of the last leader, is resumed if
+// the members are still its servers, the ranges it copied are not copied
+// again; otherwise it is rolled back and the old ring stays. Nothing written
+// meanwhile is lost then, the writes went to the old ring too.
+func (l *clusterLoop) takeOver(st *ClusterState, members []string) {
+	m := st.Migration
+	resume := len(st.Target) > 0 && SameAddrs(st.Target, members)
+	if len(st.Target) > 0 && !resume && m != nil && m.State == "RUNNING" {
+		log.Println("roll back the migration to", st.Target)
+		m.State = "ABORTED"
+		m.Err = "rolled back"
+		m.End = time.Now()
+	}
+	if e := schd.Follow(&ClusterState{Ring: st.Ring, Migration: m}); e != nil {
+		log.Print("follow the ring failed: ", e)
+		return
+	}
+	if resume {
+		// the writes go on to the target without a gap
+		log.Println("resume the migration to", st.Target)
+		if e := client.UpdateServers(st.Target); e != nil {
+			log.Print("update servers failed: ", e)
+		}
+		l.tried = time.Now()
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	. "caskdb/protocol"
 	"compress/gzip"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/robfig/config"
@@ -155,7 +156,8 @@ var server_stats []map[string]interface{}
 var proxy_stats []map[string]interface{}
 var total_records, uniq_records uint64
 var bucket_stats []string
-var schd Scheduler
+var schd *Scheduler
+var ringServers []string // the servers the ring is moving to
 var client *Client
 
 func update_stats(servers []string, hosts []*Host, server_stats []map[string]interface{}, isNode bool) {
@@ -176,15 +178,25 @@ func update_stats(servers []string, hosts []*Host, server_stats []map[string]int
 			log.Print("update stats failed", err)
 		}
 	}()
+	var shares map[string]float64
+	var states map[string]string
+	if schd != nil {
+		shares = schd.Shares()
+		states = schd.HostStates()
+	}
 	for i, h := range hosts {
+		ring := fmt.Sprintf("%.1f%%", shares[h.Addr]*100)
 		t, err := h.Stat()
 		if err != nil {
-			server_stats[i] = map[string]interface{}{"name": h.Addr}
+			server_stats[i] = map[string]interface{}{"name": h.Addr, "ring": ring,
+				"state": states[h.Addr]}
 			continue
 		}
 
 		st := make(map[string]interface{})
 		st["name"] = h.Addr
+		st["ring"] = ring
+		st["state"] = states[h.Addr]
 		//log.Print(h.Addr, t)
 		for k, v := range t {
 			switch k {
@@ -257,7 +269,8 @@ func init() {
 	tmpls = new(template.Template)
 	tmpls = tmpls.Funcs(funcs)
 	tmpls = template.Must(tmpls.ParseFiles(STATIC_DIR+"index.html", STATIC_DIR+"header.html",
-		STATIC_DIR+"matrix.html", STATIC_DIR+"server.html"))
+		STATIC_DIR+"matrix.html", STATIC_DIR+"server.html", STATIC_DIR+"migration.html",
+		STATIC_DIR+"repair.html", STATIC_DIR+"health.html", STATIC_DIR+"prefix.html"))
 }
 
 func Status(w http.ResponseWriter, req *http.Request) {
@@ -283,6 +296,12 @@ func Status(w http.ResponseWriter, req *http.Request) {
 	data["all_sections"] = all_sections
 	data["server_stats"] = server_stats
 	data["proxy_stats"] = proxy_stats
+	if schd != nil {
+		data["migration"] = schd.Migration()
+		data["repair"] = schd.Repair()
+		data["prefix_delete"] = schd.PrefixDelete()
+		data["host_events"] = schd.HostEvents()
+	}
 
 	//st := schd.Stats()
 	stats := make([]map[string]interface{}, len(server_stats))
@@ -326,6 +345,24 @@ func getServers(serverss string) []string {
 	return servers
 }
 
+// getWeights parses "host:port=weight,..."
+func getWeights(weightss string) map[string]int {
+	weights := make(map[string]int)
+	for _, s := range strings.Split(weightss, ",") {
+		p := strings.LastIndex(s, "=")
+		if p < 0 {
+			continue
+		}
+		w, e := strconv.Atoi(strings.TrimSpace(s[p+1:]))
+		if e != nil || w < 1 {
+			log.Print("invalid weight ", s)
+			continue
+		}
+		weights[strings.TrimSpace(s[:p])] = w
+	}
+	return weights
+}
+
 func checkServers(client *Client, oldServers []string) {
 	c, err := config.ReadDefault(*conf)
 	if err == nil {
@@ -333,13 +370,25 @@ func checkServers(client *Client, oldServers []string) {
 		if e == nil {
 			newServers := getServers(serverss)
 			log.Println(oldServers, newServers)
-			if len(oldServers) < len(newServers) {
+			if strings.Join(oldServers, ",") != strings.Join(newServers, ",") {
 				if AccessLog != nil {
 					AccessLog.Println(newServers)
 				}
-				client.UpdateServers(newServers)
 				oldServers = newServers
+				ringServers = newServers
 				server_stats = make([]map[string]interface{}, len(newServers))
+				if cluster != nil {
+					if e := cluster.SetMembers(newServers); e != nil {
+						log.Print("set members failed: ", e)
+					}
+				}
+			}
+			// compare with the ring, so that an aborted migration
+			// is tried again
+			if cluster == nil && !schd.Migrating() && !SameAddrs(schd.Servers(), ringServers) {
+				if e := client.UpdateServers(ringServers); e != nil {
+					log.Print("update servers failed: ", e)
+				}
 			}
 		}
 	}
@@ -361,6 +410,13 @@ func main() {
 		log.Fatal("no servers in conf")
 	}
 	servers := getServers(serverss)
+	replicas, e := c.Int("default", "replicas")
+	if e != nil {
+		replicas = 2
+	}
+	if replicas < 1 || replicas > len(servers) {
+		log.Fatal("replicas should be between 1 and the number of servers")
+	}
 
 	if port, e := c.Int("monitor", "port"); e != nil {
 		log.Print("no port in conf", e.Error())
@@ -409,13 +465,198 @@ func main() {
 	}
 	SlowCmdTime = time.Duration(int64(slow) * 1e6)
 
-	schd := NewScheduler(servers)
+	vnodes, e := c.Int("default", "vnodes")
+	if e != nil {
+		vnodes = 1
+	}
+	weights := make(map[string]int)
+	if ws, e := c.String("default", "weights"); e == nil {
+		weights = getWeights(ws)
+	}
+	hash, e := c.String("default", "hash_method")
+	if e != nil {
+		hash = "crc32"
+	}
+	if _, ok := HashMethods[hash]; !ok {
+		log.Fatal("unknown hash_method ", hash)
+	}
+	schd = NewScheduler(servers, RingOptions{Replicas: replicas, VNodes: vnodes,
+		Weights: weights, Hash: hash})
+	ringServers = servers
 	client = NewClient(schd)
+	if level, e := c.String("proxy", "read_consistency"); e == nil {
+		if client.ReadLevel, e = ParseConsistency(level); e != nil {
+			log.Fatal(e.Error())
+		}
+	}
+	if level, e := c.String("proxy", "write_consistency"); e == nil {
+		if client.WriteLevel, e = ParseConsistency(level); e != nil {
+			log.Fatal(e.Error())
+		}
+	}
+	if repair, e := c.Bool("proxy", "read_repair"); e == nil {
+		client.ReadRepair = repair
+	}
+	// keys ns:... of a namespace go to its own servers
+	router := NewRouter(client)
+	var nsScheds []*Scheduler
+	if names, e := c.Options("namespaces"); e == nil {
+		for _, ns := range names {
+			if c.HasOption("default", ns) {
+				// inherited from the default section
+				continue
+			}
+			s, _ := c.String("namespaces", ns)
+			addrs := strings.Split(s, ",")
+			if len(addrs) < replicas {
+				log.Fatal("less servers than replicas in namespace ", ns)
+			}
+			sch := NewScheduler(addrs, RingOptions{Replicas: replicas, VNodes: vnodes,
+				Weights: weights, Hash: hash})
+			nc := NewClient(sch)
+			nc.ReadLevel, nc.WriteLevel, nc.ReadRepair = client.ReadLevel, client.WriteLevel, client.ReadRepair
+			router.Route(ns, nc)
+			nsScheds = append(nsScheds, sch)
+			log.Println("namespace", ns, "on", addrs)
+		}
+	}
 
 	http.HandleFunc("/data", func(w http.ResponseWriter, req *http.Request) {
 	})
+	// decommission a server, POST only: its data is handed off to the new
+	// owners before it leaves the ring
+	http.HandleFunc("/remove", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "POST server=<addr> to remove it", http.StatusMethodNotAllowed)
+			return
+		}
+		addr := req.FormValue("server")
+		members := schd.Servers()
+		if cluster != nil {
+			st, e := cluster.Load()
+			if e != nil {
+				http.Error(w, e.Error(), http.StatusInternalServerError)
+				return
+			}
+			members = st.Members
+		}
+		var servers []string
+		for _, s := range members {
+			if s != addr {
+				servers = append(servers, s)
+			}
+		}
+		if len(servers) == len(members) {
+			http.Error(w, "no server "+addr, http.StatusNotFound)
+			return
+		}
+		if cluster != nil {
+			// the leader migrates the ring
+			if e := cluster.SetMembers(servers); e != nil {
+				http.Error(w, e.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintln(w, "removing", addr)
+			return
+		}
+		if e := client.UpdateServers(servers); e != nil {
+			http.Error(w, e.Error(), http.StatusConflict)
+			return
+		}
+		ringServers = servers
+		fmt.Fprintln(w, "removing", addr)
+	})
+	// progress of the last migration
+	http.HandleFunc("/migration", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schd.Migration())
+	})
+	// progress of the last repair, POST starts a new one
+	http.HandleFunc("/repair", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			if !leading() {
+				http.Error(w, "not the leader", http.StatusConflict)
+				return
+			}
+			if e := schd.StartRepair(); e != nil {
+				http.Error(w, e.Error(), http.StatusConflict)
+				return
+			}
+			for _, sch := range nsScheds {
+				if e := sch.StartRepair(); e != nil {
+					log.Print("repair of namespace not started: ", e)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schd.Repair())
+	})
+	// progress of the last delete prefix, POST with prefix starts a new one
+	http.HandleFunc("/delete_prefix", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			if !leading() {
+				http.Error(w, "not the leader", http.StatusConflict)
+				return
+			}
+			prefix := req.FormValue("prefix")
+			if e := schd.StartDeletePrefix(prefix); e != nil {
+				http.Error(w, e.Error(), http.StatusConflict)
+				return
+			}
+			// and on the rings of the namespaces the prefix covers
+			for _, sch := range nsScheds {
+				ns := sch.Keyspace().Only + ":"
+				if !strings.HasPrefix(prefix, ns) && !strings.HasPrefix(ns, prefix) {
+					continue
+				}
+				if e := sch.StartDeletePrefix(prefix); e != nil {
+					log.Print("delete prefix of namespace not started: ", e)
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(schd.PrefixDelete())
+	})
+	// states of the servers and their last changes
+	http.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"states": schd.HostStates(), "events": schd.HostEvents()})
+	})
+	interval, e := c.Int("default", "health_interval")
+	if e != nil {
+		interval = 3
+	}
+	go func() {
+		for {
+			schd.CheckHealth()
+			for _, sch := range nsScheds {
+				sch.CheckHealth()
+			}
+			time.Sleep(time.Duration(interval) * time.Second)
+		}
+	}()
+	if hours, e := c.Int("default", "repair_interval"); e == nil && hours > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(hours) * time.Hour)
+				if !leading() {
+					continue
+				}
+				if e := schd.StartRepair(); e != nil {
+					log.Print("scheduled repair not started: ", e)
+				}
+				for _, sch := range nsScheds {
+					if e := sch.StartRepair(); e != nil {
+						log.Print("scheduled repair of namespace not started: ", e)
+					}
+				}
+			}
+		}()
+	}
 
-	proxy := NewServer(client)
+	proxy := NewServer(router)
 	listen, e := c.String("proxy", "listen")
 	if e != nil {
 		listen = "0.0.0.0"
@@ -425,6 +666,36 @@ func main() {
 		log.Fatal("no proxy port in conf", e.Error())
 	}
 	addr := fmt.Sprintf("%s:%d", listen, port)
+
+	// a cluster is only formed by a state_file given in the configure file
+	path, _ := c.String("default", "state_file")
+	if path != "" {
+		// take the ring of the last run before serving, and migrate it to
+		// the servers of the configure file
+		cluster = NewStateFile(path)
+		client.Refresh = refresh
+		if e := cluster.SetMembers(servers); e != nil {
+			log.Fatal("state_file ", e.Error())
+		}
+		hostname, _ := os.Hostname()
+		l := &clusterLoop{id: fmt.Sprintf("%s:%d", hostname, port)}
+		l.tick()
+		go l.run()
+	}
+	// the shared state, with the leader
+	http.HandleFunc("/cluster", func(w http.ResponseWriter, req *http.Request) {
+		if cluster == nil {
+			http.Error(w, "state_file is empty", http.StatusNotFound)
+			return
+		}
+		st, e := cluster.Load()
+		if e != nil {
+			http.Error(w, e.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	})
 	if e = proxy.Listen(addr); e != nil {
 		log.Fatal("proxy listen failed", e.Error())
 	}
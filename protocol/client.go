@@ -7,6 +7,7 @@ package protocol
 import (
 	"fmt"
 	"log"
+	"sync/atomic"
 )
 
 type MODE int
@@ -19,7 +20,13 @@ const (
 
 // Client of memcached
 type Client struct {
-	sch *Scheduler
+	sch        *Scheduler
+	ReadLevel  Consistency
+	WriteLevel Consistency // ONE writes the primary and replicates async
+	ReadRepair bool        // read all replicas and fix the stale ones
+	Refresh    func()      // updates the ring after a server replied MOVED
+
+	readRepairs, readRepairErrors int64
 }
 
 func NewClient(sch *Scheduler) (c *Client) {
@@ -29,9 +36,12 @@ func NewClient(sch *Scheduler) (c *Client) {
 }
 
 func (c *Client) Get(key string) (r *Item, err error) {
+	if c.ReadLevel != ONE || c.ReadRepair {
+		return c.getQuorum(key)
+	}
 	hosts := c.sch.GetHostsByKey(key)
 	for _, h := range hosts {
-		r, err := h.Get(key)
+		r, err = h.Get(key)
 		if err == nil {
 			return r, nil
 		} else {
@@ -41,60 +51,224 @@ func (c *Client) Get(key string) (r *Item, err error) {
 	return
 }
 
-func (c *Client) Set(key string, item *Item, noreply bool) (bool, error) {
-	hosts := make([]*Host, 2)
-	if c.sch.IsMegrating {
-		hosts = c.sch.GetHostsByKey2(key)
-	} else {
-		hosts = c.sch.GetHostsByKey(key)
-	}
-
-	if len(hosts) == 2 {
-		key2 := key + "@#$" + hosts[1].Addr
-		ok, e := hosts[0].Set(key2, item, noreply)
-		// treat hosts[1] to the main copy node
-		if !ok {
-			key2 = key + "@#$" + hosts[0].Addr
-			ok, e = hosts[1].Set(key2, item, noreply)
+// GetMulti groups keys by the primary host owning them and queries the hosts
+// in parallel; the keys of a host that fails are asked to their next
+// replica, again grouped by host. A key without any live replica left is an
+// error.
+func (c *Client) GetMulti(keys []string) (map[string]*Item, error) {
+	if c.ReadLevel != ONE || c.ReadRepair {
+		return c.getMultiQuorum(keys)
+	}
+	replicas := make(map[string][]*Host, len(keys))
+	for _, key := range keys {
+		replicas[key] = c.sch.GetHostsByKey(key)
+	}
+
+	type result struct {
+		host  *Host
+		keys  []string
+		items map[string]*Item
+		err   error
+	}
+	rs := make(map[string]*Item, len(keys))
+	errs := make(map[string]error) // of the last replica asked
+	var err error
+	for i := 0; len(keys) > 0; i++ {
+		groups := make(map[*Host][]string)
+		for _, key := range keys {
+			if hosts := replicas[key]; i < len(hosts) {
+				groups[hosts[i]] = append(groups[hosts[i]], key)
+			} else if errs[key] != nil {
+				err = errs[key]
+			} else {
+				err = fmt.Errorf("no live replica of %s", key)
+			}
+		}
+		results := make(chan result, len(groups))
+		for h, ks := range groups {
+			go func(h *Host, ks []string) {
+				items, err := h.GetMulti(ks)
+				results <- result{h, ks, items, err}
+			}(h, ks)
+		}
+		keys = nil
+		for j := 0; j < len(groups); j++ {
+			r := <-results
+			if r.err != nil {
+				e := fmt.Errorf("%s : %s", r.host.Addr, r.err.Error())
+				for _, key := range r.keys {
+					errs[key] = e
+				}
+				keys = append(keys, r.keys...)
+				continue
+			}
+			for key, item := range r.items {
+				rs[key] = item
+			}
 		}
-		if !ok || e != nil {
-			return ok, fmt.Errorf("%s : %s", hosts[1].Addr, e.Error())
+	}
+	return rs, err
+}
+
+// getWriteHosts returns the routes to the replicas of key writes go to,
+// see GetWriteHostsByKey, which send the epoch of the ring along.
+func (c *Client) getWriteHosts(key string) []*Route {
+	hosts := c.sch.GetWriteHostsByKey(key)
+	epoch := c.sch.Epoch()
+	routes := make([]*Route, len(hosts))
+	for i, h := range hosts {
+		routes[i] = &Route{Host: h, Epoch: epoch}
+	}
+	return routes
+}
+
+// moved tells whether e is a MOVED reply, and refreshes the ring then.
+func (c *Client) moved(e error) bool {
+	if _, ok := e.(*MovedError); !ok {
+		return false
+	}
+	if c.Refresh != nil {
+		c.Refresh()
+	}
+	return true
+}
+
+// replicated runs a write on the primary replica of key, which copies the
+// result to the other replicas. The next replica takes over when the
+// primary fails. The replicas which are down get the copy too, it waits in
+// the hints of the primary until they are back. A write refused with MOVED
+// is tried once more with the refreshed ring.
+func (c *Client) replicated(key string, op func(h *Route, key string) (bool, error)) (ok bool, e error) {
+	ok, e = c.replicate(key, op)
+	if c.moved(e) {
+		ok, e = c.replicate(key, op)
+	}
+	return
+}
+
+func (c *Client) replicate(key string, op func(h *Route, key string) (bool, error)) (ok bool, e error) {
+	hosts := c.getWriteHosts(key)
+	down := c.sch.GetDownHostsByKey(key)
+	for i, h := range hosts {
+		if len(hosts)+len(down) > 1 {
+			others := make([]string, 0, len(hosts)+len(down)-1)
+			for j, o := range hosts {
+				if j != i {
+					others = append(others, o.Addr)
+				}
+			}
+			for _, o := range down {
+				others = append(others, o.Addr)
+			}
+			h.Replicas = others
 		}
-	} else {
-		ok, e := hosts[0].Set(key, item, noreply)
-		if !ok || e != nil {
-			return ok, fmt.Errorf("%s : %s", hosts[0].Addr, e.Error())
+		ok, e = op(h, key)
+		if _, moved := e.(*MovedError); e == nil || e == ErrNotNumeric || moved {
+			return ok, e
 		}
+		e = fmt.Errorf("%s : %s", h.Addr, e.Error())
 	}
-	return true, nil
+	return
 }
 
-func (c *Client) Delete(key string) (r bool, err error) {
-	hosts := make([]*Host, 2)
-	if c.sch.IsMegrating {
-		hosts = c.sch.GetHostsByKey2(key)
-	} else {
-		hosts = c.sch.GetHostsByKey(key)
+// write runs op with the configured write consistency.
+func (c *Client) write(key string, op func(h *Route, key string) (bool, error)) (bool, error) {
+	if c.WriteLevel == ONE {
+		return c.replicated(key, op)
 	}
+	return c.writeQuorum(key, op)
+}
 
-	if len(hosts) == 2 {
-		key += "@@" + hosts[1].Addr
+func (c *Client) Set(key string, item *Item, noreply bool) (bool, error) {
+	if c.WriteLevel != ONE {
+		return c.setQuorum(key, item)
 	}
-	ok, e := hosts[0].Delete(key)
-	if !ok || e != nil {
-		return ok, fmt.Errorf("%s : %s", hosts[0].Addr, e.Error())
+	return c.replicated(key, func(h *Route, key string) (bool, error) {
+		return h.Set(key, item, noreply)
+	})
+}
+
+func (c *Client) Add(key string, item *Item, noreply bool) (bool, error) {
+	return c.write(key, func(h *Route, key string) (bool, error) {
+		return h.Add(key, item, noreply)
+	})
+}
+
+func (c *Client) Replace(key string, item *Item, noreply bool) (bool, error) {
+	return c.write(key, func(h *Route, key string) (bool, error) {
+		return h.Replace(key, item, noreply)
+	})
+}
+
+func (c *Client) Append(key string, item *Item, noreply bool) (bool, error) {
+	return c.write(key, func(h *Route, key string) (bool, error) {
+		return h.Append(key, item, noreply)
+	})
+}
+
+func (c *Client) Prepend(key string, item *Item, noreply bool) (bool, error) {
+	return c.write(key, func(h *Route, key string) (bool, error) {
+		return h.Prepend(key, item, noreply)
+	})
+}
+
+// Cas is checked against the primary replica, the new cas unique is then
+// propagated to the other replicas along with the value.
+func (c *Client) Cas(key string, item *Item, noreply bool) (status string, err error) {
+	_, err = c.write(key, func(h *Route, key string) (bool, error) {
+		var e error
+		status, e = h.Cas(key, item, noreply)
+		return status == "STORED", e
+	})
+	return
+}
+
+func (c *Client) Incr(key string, delta int64, noreply bool) (n uint64, ok bool, err error) {
+	ok, err = c.write(key, func(h *Route, key string) (bool, error) {
+		var ok bool
+		var e error
+		n, ok, e = h.Incr(key, delta, noreply)
+		return ok, e
+	})
+	return
+}
+
+func (c *Client) Touch(key string, exptime int, noreply bool) (bool, error) {
+	return c.write(key, func(h *Route, key string) (bool, error) {
+		return h.Touch(key, exptime, noreply)
+	})
+}
+
+// Delete leaves a tombstone on all replicas, which keeps the older copies
+// of key from coming back.
+func (c *Client) Delete(key string) (bool, error) {
+	if c.WriteLevel != ONE {
+		return c.deleteQuorum(key)
 	}
-	return true, nil
+	return c.replicated(key, func(h *Route, key string) (bool, error) {
+		return h.Delete(key)
+	})
 }
 
 func (c *Client) FlushAll() {
-	for _, h := range c.sch.hosts {
+	c.sch.RLock()
+	hosts := c.sch.allHosts()
+	c.sch.RUnlock()
+	for _, h := range hosts {
 		h.FlushAll()
 	}
 }
-func (c *Client) UpdateServers(addrs []string) {
+func (c *Client) UpdateServers(addrs []string) error {
 	log.Println("UpdataServers")
-	c.sch.Update(addrs)
+	return c.sch.Update(addrs)
+}
+
+// Stats reports the copies written back by read repair.
+func (c *Client) Stats() map[string]int64 {
+	return map[string]int64{
+		"read_repairs":       atomic.LoadInt64(&c.readRepairs),
+		"read_repair_errors": atomic.LoadInt64(&c.readRepairErrors),
+	}
 }
 
 func (c *Client) Len() int64 {
@@ -0,0 +1,237 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestClientGetMulti(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		addrs = append(addrs, startServer(t, NewMapStore()))
+	}
+	client := NewClient(NewScheduler(addrs, RingOptions{Replicas: 2}))
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		for _, h := range client.sch.GetHostsByKey(keys[i]) {
+			h.Set(keys[i], &Item{Body: []byte(keys[i])}, false)
+		}
+	}
+	items, e := client.GetMulti(append(keys, "nokey"))
+	if e != nil {
+		t.Errorf("GetMulti %s\n", e.Error())
+	}
+	if len(items) != len(keys) {
+		t.Errorf("GetMulti expect %d items, but got %d\n", len(keys), len(items))
+	}
+	for _, key := range keys {
+		if item, ok := items[key]; !ok || string(item.Body) != key {
+			t.Errorf("GetMulti %s: got %v\n", key, item)
+		}
+	}
+}
+
+func TestClientGetMultiFallback(t *testing.T) {
+	// nothing listens on the first one
+	live := startServer(t, NewMapStore())
+	sch := NewScheduler([]string{freeAddr(t), live}, RingOptions{Replicas: 2})
+	client := NewClient(sch)
+	keys := []string{"key0", "key1", "key2", "key3"}
+	for _, key := range keys {
+		NewHost(live).Set(key, &Item{Body: []byte(key)}, false)
+	}
+	if items, e := client.GetMulti(keys); e != nil || len(items) != len(keys) {
+		t.Errorf("GetMulti got %v %v\n", items, e)
+	}
+
+	// no live replica left
+	sch = NewScheduler([]string{freeAddr(t)}, RingOptions{Replicas: 1})
+	for i := 0; i < DownAfter; i++ {
+		sch.CheckHealth()
+	}
+	if items, e := NewClient(sch).GetMulti(keys); e == nil || len(items) != 0 {
+		t.Errorf("GetMulti without replicas got %v %v\n", items, e)
+	}
+}
+
+func TestClientQuorum(t *testing.T) {
+	// nothing listens on the last one
+	addrs := []string{startServer(t, NewMapStore()), startServer(t, NewMapStore()), freeAddr(t)}
+	client := NewClient(NewScheduler(addrs, RingOptions{Replicas: 3}))
+
+	client.WriteLevel = QUORUM
+	if ok, e := client.Set("key", &Item{Body: []byte("v")}, false); !ok || e != nil {
+		t.Errorf("Set QUORUM got %t %v\n", ok, e)
+	}
+	client.WriteLevel = ALL
+	if _, e := client.Set("key", &Item{Body: []byte("v")}, false); e == nil {
+		t.Errorf("Set ALL should fail\n")
+	}
+	if _, e := client.Add("key2", &Item{Body: []byte("v")}, false); e == nil {
+		t.Errorf("Add ALL should fail\n")
+	}
+
+	client.ReadLevel = QUORUM
+	if item, e := client.Get("key2"); item == nil || e != nil {
+		t.Errorf("Get QUORUM got %v %v\n", item, e)
+	}
+	if items, e := client.GetMulti([]string{"key", "key2"}); len(items) != 2 || e != nil {
+		t.Errorf("GetMulti QUORUM got %v %v\n", items, e)
+	}
+	client.ReadLevel = ALL
+	if _, e := client.Get("key"); e == nil {
+		t.Errorf("Get ALL should fail\n")
+	}
+
+	if _, e := client.Delete("key"); e == nil {
+		t.Errorf("Delete ALL should fail\n")
+	}
+	client.WriteLevel = QUORUM
+	client.ReadLevel = QUORUM
+	if ok, e := client.Delete("key2"); !ok || e != nil {
+		t.Errorf("Delete QUORUM got %t %v\n", ok, e)
+	}
+	if item, e := client.Get("key2"); item != nil || e != nil {
+		t.Errorf("Get deleted got %v %v\n", item, e)
+	}
+
+	// the copies keep the exptime of the touched key
+	client.Set("key3", &Item{Body: []byte("v")}, false)
+	if ok, e := client.Touch("key3", 2000000000, false); !ok || e != nil {
+		t.Errorf("Touch QUORUM got %t %v\n", ok, e)
+	}
+	for _, addr := range addrs[:2] {
+		items, e := NewHost(addr).Fetch([]string{"key3"})
+		if e != nil || items["key3"] == nil || items["key3"].Exptime != 2000000000 {
+			t.Errorf("%s got %v %v\n", addr, items["key3"], e)
+		}
+	}
+}
+
+// replicaStore copies writes to the other replicas at once.
+type replicaStore struct {
+	*mapStore
+}
+
+func (s replicaStore) Replicate(key string, addrs []string) {
+	s.lock.Lock()
+	item := s.data[key]
+	s.lock.Unlock()
+	for _, addr := range addrs {
+		NewHost(addr).Set(key, item, false)
+	}
+}
+
+func TestClientReplicate(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		addrs = append(addrs, startServer(t, replicaStore{NewMapStore()}))
+	}
+	client := NewClient(NewScheduler(addrs, RingOptions{Replicas: 2}))
+
+	if ok, e := client.Set("key", &Item{Body: []byte("v")}, false); !ok || e != nil {
+		t.Errorf("Set got %t %v\n", ok, e)
+	}
+	if n, ok, e := client.Incr("key", 1, false); ok || e != ErrNotNumeric {
+		t.Errorf("Incr non-numeric got %d %t %v\n", n, ok, e)
+	}
+	if ok, e := client.Append("key", &Item{Body: []byte("w")}, false); !ok || e != nil {
+		t.Errorf("Append got %t %v\n", ok, e)
+	}
+	var cas uint64
+	for _, h := range client.sch.GetHostsByKey("key") {
+		item, e := h.Get("key")
+		if e != nil || item == nil || string(item.Body) != "vw" {
+			t.Fatalf("%s got %v %v\n", h.Addr, item, e)
+		}
+		if cas != 0 && item.Cas != cas {
+			t.Errorf("%s got cas %d, expect %d\n", h.Addr, item.Cas, cas)
+		}
+		cas = item.Cas
+	}
+
+	if ok, e := client.Delete("key"); !ok || e != nil {
+		t.Errorf("Delete got %t %v\n", ok, e)
+	}
+	if ok, e := client.Delete("key"); ok || e != nil {
+		t.Errorf("Delete again got %t %v\n", ok, e)
+	}
+	for _, h := range client.sch.GetHostsByKey("key") {
+		// a copy older than the tombstone is dropped
+		h.Set("key", &Item{Body: []byte("vw"), Cas: cas}, false)
+		if item, e := h.Get("key"); item != nil || e != nil {
+			t.Errorf("%s got deleted key %v %v\n", h.Addr, item, e)
+		}
+	}
+}
+
+func TestClientReadRepair(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, NewMapStore()))
+	}
+	client := NewClient(NewScheduler(addrs, RingOptions{Replicas: 3}))
+	client.ReadRepair = true
+
+	hosts := client.sch.GetHostsByKey("key")
+	exptime := int(time.Now().Unix()) + 3600
+	hosts[0].Set("key", &Item{Body: []byte("old"), Cas: 1}, false)
+	hosts[1].Set("key", &Item{Body: []byte("new"), Cas: 2, Exptime: exptime}, false)
+	hosts[0].Set("key2", &Item{Body: []byte("v"), Cas: 1}, false)
+
+	if item, e := client.Get("key"); e != nil || item == nil || string(item.Body) != "new" {
+		t.Fatalf("Get got %v %v\n", item, e)
+	}
+	if items, e := client.GetMulti([]string{"key2"}); e != nil || len(items) != 1 {
+		t.Fatalf("GetMulti got %v %v\n", items, e)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, h := range client.sch.GetHostsByKey("key") {
+		items, e := h.Fetch([]string{"key", "key2"})
+		for key, body := range map[string]string{"key": "new", "key2": "v"} {
+			if item := items[key]; e != nil || item == nil || string(item.Body) != body {
+				t.Errorf("%s %s got %v %v\n", h.Addr, key, item, e)
+			}
+		}
+		// the copies keep their expiry
+		if item := items["key"]; item != nil && item.Exptime != exptime {
+			t.Errorf("%s key expires at %d, expect %d\n", h.Addr, item.Exptime, exptime)
+		}
+	}
+	if n := client.Stats()["read_repairs"]; n != 4 {
+		t.Errorf("read_repairs got %d, expect 4\n", n)
+	}
+}
+
+func TestClientReadDeleted(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, NewMapStore()))
+	}
+	client := NewClient(NewScheduler(addrs, RingOptions{Replicas: 3}))
+	client.ReadLevel = ALL
+	client.ReadRepair = true
+
+	// a delete missed by the first replica, and a value expired since
+	hosts := client.sch.GetHostsByKey("key")
+	hosts[0].Set("key", &Item{Body: []byte("v"), Cas: 1}, false)
+	hosts[1].Set("key", &Item{Cas: 2, Deleted: true}, false)
+	hosts[0].Set("key2", &Item{Body: []byte("v"), Cas: 1}, false)
+	hosts[1].Set("key2", &Item{Body: []byte("v"), Cas: 2, Exptime: MaxRelativeExptime + 1}, false)
+
+	if item, e := client.Get("key"); e != nil || item != nil {
+		t.Errorf("Get deleted key got %v %v\n", item, e)
+	}
+	if items, e := client.GetMulti([]string{"key", "key2"}); e != nil || len(items) != 0 {
+		t.Errorf("GetMulti deleted keys got %v %v\n", items, e)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, h := range hosts {
+		if items, e := h.Fetch([]string{"key"}); e != nil || items["key"] == nil || !items["key"].Deleted {
+			t.Errorf("%s got %v %v\n", h.Addr, items["key"], e)
+		}
+	}
+}
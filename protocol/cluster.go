@@ -0,0 +1,226 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Several masters share the ring through a state file: one of them holds a
+// lease on it and drives the migrations, the others follow the ring it
+// publishes. All of them serve as proxies.
+
+// ClusterState is the content of the state file.
+type ClusterState struct {
+	Leader    string     // id of the master driving the migrations
+	Lease     time.Time  // until when the leader holds the lease
+	Members   []string   // the servers the ring should have
+	Version   int        // of Ring and Target, bumped by every change
+	Ring      []string   // the servers reads go to
+	Target    []string   `json:",omitempty"` // the ring writes go to while migrating
+	Migration *Migration `json:",omitempty"` // the last one, with its tasks
+}
+
+// StateFile keeps the ring of the master across restarts. It is shared by
+// the masters on the same machine, or on a shared file system with working
+// flock. Their clocks have to agree within a fraction of the lease.
+type StateFile struct {
+	path string
+}
+
+func NewStateFile(path string) *StateFile {
+	return &StateFile{path: path}
+}
+
+// Load reads the state, which is empty if the file does not exist yet.
+func (f *StateFile) Load() (*ClusterState, error) {
+	st := new(ClusterState)
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Update changes the state with fn while holding the lock of the file, fn
+// returns whether there is anything to write.
+func (f *StateFile) Update(fn func(st *ClusterState) bool) (*ClusterState, error) {
+	lock, err := os.OpenFile(f.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	st, err := f.Load()
+	if err != nil {
+		return nil, err
+	}
+	if !fn(st) {
+		return st, nil
+	}
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	// readers see the old state or the new one, never a part
+	tmp := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(tmp, f.path); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Campaign renews the lease of master id, or takes it over once it expired,
+// and tells whether id is the leader.
+func (f *StateFile) Campaign(id string, lease time.Duration) (*ClusterState, bool, error) {
+	leader := false
+	st, err := f.Update(func(st *ClusterState) bool {
+		now := time.Now()
+		if st.Leader != id && now.Before(st.Lease) {
+			return false
+		}
+		if st.Leader != id {
+			log.Println(id, "takes over the lease from", st.Leader)
+		}
+		st.Leader = id
+		st.Lease = now.Add(lease)
+		leader = true
+		return true
+	})
+	return st, leader, err
+}
+
+// Publish writes the ring of the leader id, it fails if id lost the lease.
+func (f *StateFile) Publish(id string, ring, target []string, m *Migration) (*ClusterState, error) {
+	lost := false
+	st, err := f.Update(func(st *ClusterState) bool {
+		if st.Leader != id {
+			lost = true
+			return false
+		}
+		if !SameAddrs(st.Ring, ring) || !SameAddrs(st.Target, target) {
+			st.Version++
+		}
+		st.Ring, st.Target, st.Migration = ring, target, m
+		return true
+	})
+	if err == nil && lost {
+		err = errors.New("not the leader")
+	}
+	return st, err
+}
+
+// SetMembers changes the servers the ring should have, the leader migrates
+// the ring to them.
+func (f *StateFile) SetMembers(servers []string) error {
+	_, err := f.Update(func(st *ClusterState) bool {
+		if SameAddrs(st.Members, servers) {
+			return false
+		}
+		st.Members = servers
+		return true
+	})
+	return err
+}
+
+// SameAddrs tells whether the lists of servers a and b are the same, in
+// the same order.
+func SameAddrs(a, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// Target returns the servers of the ring being migrated to, nil if there is
+// no migration.
+func (c *Scheduler) Target() []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	if !c.IsMegrating {
+		return nil
+	}
+	return hostAddrs(c.hosts2)
+}
+
+// Follow moves the ring to the one published by the leader, without copying
+// anything: reads go to st.Ring, and writes to st.Target while the leader
+// migrates to it. It fails while a migration of this scheduler is running.
+func (c *Scheduler) Follow(st *ClusterState) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.driving {
+		return errors.New("migration in progress")
+	}
+	if len(st.Ring) < c.opts.Replicas {
+		return errors.New("less servers than replicas")
+	}
+
+	// keep the connections and the health of the known servers
+	before := c.allHosts()
+	defer c.retire(before)
+	known := make(map[string]*Host, len(before))
+	for _, h := range before {
+		known[h.Addr] = h
+	}
+	hostsOf := func(addrs []string) []*Host {
+		hosts := make([]*Host, len(addrs))
+		for i, addr := range addrs {
+			if hosts[i] = known[addr]; hosts[i] == nil {
+				hosts[i] = NewHost(addr)
+			}
+		}
+		return hosts
+	}
+	if !SameAddrs(hostAddrs(c.hosts), st.Ring) {
+		log.Println("follow the ring", st.Ring)
+		c.hosts = hostsOf(st.Ring)
+		c.index = c.buildIndex(st.Ring)
+	}
+	if len(st.Target) >= c.opts.Replicas {
+		if !c.IsMegrating || !SameAddrs(hostAddrs(c.hosts2), st.Target) {
+			log.Println("follow the migration to", st.Target)
+			c.hosts2 = hostsOf(st.Target)
+			c.index2 = c.buildIndex(st.Target)
+			c.IsMegrating = true
+		}
+	} else if c.IsMegrating {
+		c.hosts2, c.index2 = nil, nil
+		c.IsMegrating = false
+	}
+
+	c.mlock.Lock()
+	if st.Migration != nil {
+		c.migration = st.Migration
+		if st.Migration.ID > c.migrations {
+			c.migrations = st.Migration.ID
+		}
+	}
+	c.mlock.Unlock()
+	c.SetEpoch(st)
+	return nil
+}
+
+func hostAddrs(hosts []*Host) []string {
+	addrs := make([]string, len(hosts))
+	for i, h := range hosts {
+		addrs[i] = h.Addr
+	}
+	return addrs
+}
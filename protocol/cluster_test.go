@@ -0,0 +1,130 @@
+package protocol
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempStateFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "caskdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "cluster.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestStateFileCampaign(t *testing.T) {
+	path, clean := tempStateFile(t)
+	defer clean()
+	// every master opens the file on its own
+	a, b := NewStateFile(path), NewStateFile(path)
+
+	if _, ok, err := a.Campaign("a", 200*time.Millisecond); !ok || err != nil {
+		t.Fatalf("a campaign got %t %v\n", ok, err)
+	}
+	if _, ok, err := b.Campaign("b", 200*time.Millisecond); ok || err != nil {
+		t.Fatalf("b campaign got %t %v\n", ok, err)
+	}
+	if _, err := a.Publish("a", []string{"s1", "s2"}, nil, nil); err != nil {
+		t.Errorf("a publish: %v\n", err)
+	}
+	if _, err := b.Publish("b", []string{"s1"}, nil, nil); err == nil {
+		t.Errorf("b publish should fail\n")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	st, ok, err := b.Campaign("b", 200*time.Millisecond)
+	if !ok || err != nil {
+		t.Fatalf("b campaign after the lease got %t %v\n", ok, err)
+	}
+	if st.Leader != "b" || !SameAddrs(st.Ring, []string{"s1", "s2"}) {
+		t.Errorf("state: %+v\n", st)
+	}
+	if _, ok, _ := a.Campaign("a", 200*time.Millisecond); ok {
+		t.Errorf("a should have lost the lease\n")
+	}
+}
+
+func TestStateFileUpdate(t *testing.T) {
+	path, clean := tempStateFile(t)
+	defer clean()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			f := NewStateFile(path)
+			for j := 0; j < 20; j++ {
+				_, err := f.Update(func(st *ClusterState) bool {
+					st.Members = append(st.Members, fmt.Sprintf("%d-%d", i, j))
+					return true
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	st, err := NewStateFile(path).Load()
+	if err != nil || len(st.Members) != 80 {
+		t.Errorf("got %d members %v\n", len(st.Members), err)
+	}
+}
+
+func TestSchedulerFollow(t *testing.T) {
+	addrs := []string{"host1:7901", "host2:7901", "host3:7901"}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 2})
+	h1 := sch.hosts[0]
+
+	st := &ClusterState{Ring: addrs[:2], Target: addrs, Migration: &Migration{ID: 3}}
+	if err := sch.Follow(st); err != nil {
+		t.Fatal(err)
+	}
+	if !sch.Migrating() || !SameAddrs(sch.Target(), addrs) || sch.hosts2[0] != h1 {
+		t.Errorf("follow the migration got %v %v\n", sch.Migrating(), sch.Target())
+	}
+	if m := sch.Migration(); m == nil || m.ID != 3 {
+		t.Errorf("migration got %v\n", m)
+	}
+
+	if err := sch.Follow(&ClusterState{Ring: addrs}); err != nil {
+		t.Fatal(err)
+	}
+	if sch.Migrating() || !SameAddrs(sch.Servers(), addrs) || sch.hosts[0] != h1 {
+		t.Errorf("follow the ring got %v %v\n", sch.Migrating(), sch.Servers())
+	}
+}
+
+// A migration rolled back by a new leader keeps the writes made meanwhile,
+// the old ring got them too.
+func TestSchedulerFollowRollBack(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, replicaStore{NewMapStore()}))
+	}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 1, VNodes: 10})
+	client := NewClient(sch)
+	if err := sch.Follow(&ClusterState{Ring: addrs[:2], Target: addrs}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if ok, e := client.Set(fmt.Sprintf("key%d", i), &Item{Body: []byte("v")}, false); !ok || e != nil {
+			t.Fatalf("Set while migrating got %t %v", ok, e)
+		}
+	}
+	if err := sch.Follow(&ClusterState{Ring: addrs[:2]}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if item, e := client.Get(fmt.Sprintf("key%d", i)); item == nil || e != nil {
+			t.Errorf("key%d lost by the roll back: %v", i, e)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Every version of the ring has an epoch, the version of the state file,
+// which the master pushes to the servers along with the ring. The writes of
+// the proxies carry the epoch of their ring, a server refuses those routed
+// with an older ring for keys it does not replicate with MOVED, so that the
+// proxy refreshes its ring.
+
+// RingSpec is the ring pushed to the server Self, written as
+//
+//	self replicas vnodes hash addr[=weight],... [addr[=weight],...]
+//
+// the last list being the ring of a migration, to which writes go too.
+type RingSpec struct {
+	Self            string
+	Opts            RingOptions
+	Servers, Target []string
+}
+
+func joinServers(addrs []string, opts RingOptions) string {
+	ss := make([]string, len(addrs))
+	for i, addr := range addrs {
+		ss[i] = addr
+		if w, ok := opts.Weights[addr]; ok && w != 1 {
+			ss[i] += "=" + strconv.Itoa(w)
+		}
+	}
+	return strings.Join(ss, ",")
+}
+
+func (s *RingSpec) String() string {
+	r := fmt.Sprintf("%s %d %d %s %s", s.Self, s.Opts.Replicas, s.Opts.VNodes,
+		s.Opts.Hash, joinServers(s.Servers, s.Opts))
+	if len(s.Target) > 0 {
+		r += " " + joinServers(s.Target, s.Opts)
+	}
+	return r
+}
+
+func ParseRingSpec(spec string) (*RingSpec, error) {
+	parts := strings.Fields(spec)
+	if len(parts) != 5 && len(parts) != 6 {
+		return nil, errors.New("invalid ring")
+	}
+	s := &RingSpec{Self: parts[0]}
+	var err error
+	if s.Opts.Replicas, err = strconv.Atoi(parts[1]); err != nil || s.Opts.Replicas < 1 {
+		return nil, errors.New("invalid replicas")
+	}
+	if s.Opts.VNodes, err = strconv.Atoi(parts[2]); err != nil {
+		return nil, errors.New("invalid vnodes")
+	}
+	if s.Opts.Hash = parts[3]; HashMethods[s.Opts.Hash] == nil {
+		return nil, errors.New("unknown hash method")
+	}
+	s.Opts.Weights = make(map[string]int)
+	for i, list := range parts[4:] {
+		var addrs []string
+		for _, a := range strings.Split(list, ",") {
+			if p := strings.LastIndex(a, "="); p > 0 {
+				w, err := strconv.Atoi(a[p+1:])
+				if err != nil || w < 1 {
+					return nil, errors.New("invalid weight")
+				}
+				a = a[:p]
+				s.Opts.Weights[a] = w
+			}
+			addrs = append(addrs, a)
+		}
+		if len(addrs) < s.Opts.Replicas {
+			return nil, errors.New("less servers than replicas")
+		}
+		if i == 0 {
+			s.Servers = addrs
+		} else {
+			s.Target = addrs
+		}
+	}
+	return s, nil
+}
+
+// RingOwner tells the keys a server replicates in a ring.
+type RingOwner struct {
+	Spec        *RingSpec
+	ring, ring2 *Scheduler
+}
+
+func NewRingOwner(spec *RingSpec) *RingOwner {
+	o := &RingOwner{Spec: spec, ring: NewScheduler(spec.Servers, spec.Opts)}
+	if len(spec.Target) > 0 {
+		o.ring2 = NewScheduler(spec.Target, spec.Opts)
+	}
+	return o
+}
+
+func (o *RingOwner) owns(sch *Scheduler, key string) bool {
+	for _, id := range sch.lookup(sch.hash([]byte(key)), sch.index) {
+		if sch.hosts[id].Addr == o.Spec.Self {
+			return true
+		}
+	}
+	return false
+}
+
+// Owns tells whether the server replicates key in the ring, or in the ring
+// of the migration.
+func (o *RingOwner) Owns(key string) bool {
+	return o.owns(o.ring, key) || o.ring2 != nil && o.owns(o.ring2, key)
+}
+
+// Epoch returns the epoch of the ring, 0 if there is none yet.
+func (c *Scheduler) Epoch() int64 {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	return c.epoch
+}
+
+// SetEpoch takes the ring of the state st, if it is newer, as the ring to
+// push to the servers.
+func (c *Scheduler) SetEpoch(st *ClusterState) {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if int64(st.Version) <= c.epoch || len(st.Ring) == 0 {
+		return
+	}
+	c.epoch = int64(st.Version)
+	c.epochRing, c.epochTarget = st.Ring, st.Target
+}
+
+// allHosts returns the servers of the ring and of the migration, with the
+// lock held.
+func (c *Scheduler) allHosts() []*Host {
+	hosts := append([]*Host{}, c.hosts...)
+	if c.IsMegrating {
+		for _, h := range c.hosts2 {
+			if !containHost(hosts, h) {
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	return hosts
+}
+
+// retire keeps the servers of before which left the ring, so that they get
+// the epoch in which they own nothing, with the lock held.
+func (c *Scheduler) retire(before []*Host) {
+	after := c.allHosts()
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	var retired []*Host
+	for _, h := range append(before, c.retired...) {
+		if !containHost(after, h) && !containHost(retired, h) {
+			retired = append(retired, h)
+		}
+	}
+	c.retired = retired
+}
+
+// pushRing sends the ring of the current epoch to h, unless it got it.
+func (c *Scheduler) pushRing(h *Host) {
+	c.mlock.Lock()
+	epoch := c.epoch
+	spec := &RingSpec{h.Addr, c.opts, c.epochRing, c.epochTarget}
+	pushed := h.pushed
+	c.mlock.Unlock()
+	if epoch == 0 || pushed >= epoch {
+		return
+	}
+	cur, err := h.Ring(epoch, spec)
+	if err != nil {
+		log.Println("push ring", epoch, "to", h.Addr, "failed:", err)
+		return
+	}
+	c.mlock.Lock()
+	if cur > h.pushed {
+		h.pushed = cur
+	}
+	c.unretire(h)
+	c.mlock.Unlock()
+}
+
+// unretire forgets h once it got the epoch, with mlock held.
+func (c *Scheduler) unretire(h *Host) {
+	for i, r := range c.retired {
+		if r == h && h.pushed >= c.epoch {
+			c.retired = append(c.retired[:i], c.retired[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRingSpec(t *testing.T) {
+	s := &RingSpec{"host1:7901", RingOptions{Replicas: 2, VNodes: 10, Hash: "fnv1a",
+		Weights: map[string]int{"host2:7901": 2}},
+		[]string{"host1:7901", "host2:7901"}, []string{"host1:7901", "host2:7901", "host3:7901"}}
+	str := s.String()
+	if str != "host1:7901 2 10 fnv1a host1:7901,host2:7901=2 host1:7901,host2:7901=2,host3:7901" {
+		t.Errorf("String got %s\n", str)
+	}
+	s2, err := ParseRingSpec(str)
+	if err != nil || s2.String() != str {
+		t.Errorf("ParseRingSpec got %v %v\n", s2, err)
+	}
+	for _, bad := range []string{"host1:7901 2 10 fnv1a host1:7901", "host1:7901 1 1 nohash host1:7901",
+		"host1:7901 1 1 crc32 host1:7901=0", "host1:7901 1 1 crc32"} {
+		if _, err := ParseRingSpec(bad); err == nil {
+			t.Errorf("ParseRingSpec %s should fail\n", bad)
+		}
+	}
+}
+
+// ringStore checks the writes as a data node does.
+type ringStore struct {
+	*mapStore
+	self  string
+	lock  sync.Mutex
+	ring  *RingOwner
+	epoch int64
+}
+
+func (s *ringStore) SetRing(epoch int64, spec string) (int64, error) {
+	rs, err := ParseRingSpec(spec)
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if epoch > s.epoch {
+		s.ring, s.epoch = NewRingOwner(rs), epoch
+	}
+	return s.epoch, nil
+}
+
+func (s *ringStore) Owns(key string, epoch int64) (int64, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ring == nil || epoch >= s.epoch {
+		return s.epoch, true
+	}
+	return s.epoch, s.ring.Owns(key)
+}
+
+func TestClientMoved(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		// the store knows its address before the server starts
+		store := &ringStore{mapStore: NewMapStore()}
+		server := NewServer(store)
+		if err := server.Listen("localhost:0"); err != nil {
+			t.Fatal(err)
+		}
+		store.self = server.l.Addr().String()
+		server.addr = store.self
+		go server.Serve()
+		t.Cleanup(func() { server.l.Close() })
+		addrs = append(addrs, store.self)
+	}
+	old := &ClusterState{Version: 1, Ring: addrs}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 1})
+	sch.Follow(old)
+	sch.CheckHealth()
+	for _, h := range sch.hosts {
+		if h.pushed != 1 {
+			t.Errorf("%s got epoch %d\n", h.Addr, h.pushed)
+		}
+	}
+
+	// the servers move to a ring without the second one
+	ring := &ClusterState{Version: 2, Ring: addrs[:1]}
+	stale := NewScheduler(addrs, RingOptions{Replicas: 1})
+	stale.Follow(old)
+	sch.Follow(ring)
+	sch.CheckHealth()
+
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("key%d", i)
+		if stale.GetHostsByKey(key)[0].Addr == addrs[1] {
+			break
+		}
+	}
+	client := NewClient(stale)
+	refreshed := 0
+	client.Refresh = func() {
+		refreshed++
+		stale.Follow(ring)
+	}
+	if ok, err := client.Set(key, &Item{Body: []byte("v")}, false); !ok || err != nil {
+		t.Fatalf("Set got %t %v\n", ok, err)
+	}
+	if refreshed != 1 {
+		t.Errorf("refreshed %d times\n", refreshed)
+	}
+	if item, _ := sch.hosts[0].Get(key); item == nil {
+		t.Errorf("%s not on %s\n", key, addrs[0])
+	}
+}
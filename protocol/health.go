@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// HostState is what the health checks of the master know about a server.
+// A server is suspect after a failed heartbeat and down after DownAfter of
+// them in a row, one answer brings it up again.
+type HostState int32
+
+const (
+	HostUp HostState = iota
+	HostSuspect
+	HostDown
+)
+
+func (s HostState) String() string {
+	return []string{"up", "suspect", "down"}[s]
+}
+
+var DownAfter = 3
+var MaxHostEvents = 100 // state changes kept for the monitor
+
+// HostEvent is a state change of a server.
+type HostEvent struct {
+	Time     time.Time
+	Addr     string
+	From, To string
+}
+
+func (host *Host) State() HostState {
+	return HostState(atomic.LoadInt32(&host.state))
+}
+
+// CheckHealth sends a heartbeat to every server of the rings in parallel and
+// updates their states.
+func (c *Scheduler) CheckHealth() {
+	c.RLock()
+	hosts := c.allHosts()
+	c.RUnlock()
+	c.mlock.Lock()
+	for _, h := range c.retired {
+		if !containHost(hosts, h) {
+			hosts = append(hosts, h)
+		}
+	}
+	c.mlock.Unlock()
+
+	done := make(chan bool, len(hosts))
+	for _, h := range hosts {
+		go func(h *Host) {
+			_, err := h.Version()
+			c.heartbeat(h, err == nil)
+			if err == nil {
+				c.pushRing(h)
+			}
+			done <- true
+		}(h)
+	}
+	for i := 0; i < len(hosts); i++ {
+		<-done
+	}
+}
+
+func (c *Scheduler) heartbeat(h *Host, ok bool) {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+
+	old := h.State()
+	state := HostUp
+	if ok {
+		h.fails = 0
+	} else if h.fails++; h.fails >= DownAfter {
+		state = HostDown
+	} else {
+		state = HostSuspect
+	}
+	if !ok {
+		// it may come back without its ring
+		h.pushed = 0
+	}
+	if state == HostDown {
+		// a server which left the ring is given up
+		for i, r := range c.retired {
+			if r == h {
+				c.retired = append(c.retired[:i], c.retired[i+1:]...)
+				break
+			}
+		}
+	}
+	if state == old {
+		return
+	}
+	atomic.StoreInt32(&h.state, int32(state))
+	log.Println(h.Addr, "is", state, "now, was", old)
+	c.events = append(c.events, &HostEvent{time.Now(), h.Addr, old.String(), state.String()})
+	if len(c.events) > MaxHostEvents {
+		c.events = c.events[len(c.events)-MaxHostEvents:]
+	}
+}
+
+// HostEvents returns the last state changes, the latest first.
+func (c *Scheduler) HostEvents() []HostEvent {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+
+	es := make([]HostEvent, len(c.events))
+	for i, e := range c.events {
+		es[len(es)-1-i] = *e
+	}
+	return es
+}
+
+// HostStates returns the state of every server of the rings.
+func (c *Scheduler) HostStates() map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+
+	r := make(map[string]string, len(c.hosts))
+	for _, h := range c.hosts {
+		r[h.Addr] = h.State().String()
+	}
+	for _, h := range c.hosts2 {
+		r[h.Addr] = h.State().String()
+	}
+	return r
+}
+
+// lookupLive is lookup skipping the servers which are down, the next live
+// successors on the ring stand in for them. All replicas are returned when
+// none of them is alive.
+func (c *Scheduler) lookupLive(h uint32, index []uint64, hosts []*Host) []int {
+	v := uint64(h) << 32
+	N := len(index)
+	i := sort.Search(N, func(k int) bool { return index[k] >= v })
+	ids := make([]int, 0, c.opts.Replicas)
+	for j := 0; j < N && len(ids) < c.opts.Replicas; j++ {
+		id := int(index[(i+j)%N] & 0xffffffff)
+		if hosts[id].State() != HostDown && !containInt(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return c.lookup(h, index)
+	}
+	return ids
+}
+
+// GetDownHostsByKey returns the replicas of key which are down, in the rings
+// writes go to. They miss the writes which are sent to their stand-ins.
+func (c *Scheduler) GetDownHostsByKey(key string) []*Host {
+	c.RLock()
+	defer c.RUnlock()
+
+	h := c.hash([]byte(key))
+	var r []*Host
+	down := func(index []uint64, hosts []*Host) {
+		for _, id := range c.lookup(h, index) {
+			if hosts[id].State() == HostDown && !containHost(r, hosts[id]) {
+				r = append(r, hosts[id])
+			}
+		}
+	}
+	if c.IsMegrating {
+		down(c.index2, c.hosts2)
+	}
+	down(c.index, c.hosts)
+	return r
+}
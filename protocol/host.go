@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -19,6 +20,17 @@ type Host struct {
 	Addr     string
 	nextDial time.Time
 	conns    chan net.Conn
+	state    int32 // HostState, set by the health checks
+	fails    int   // health checks failed in a row
+	pushed   int64 // the epoch of the ring the server got
+}
+
+// Route sends the writes of a request to Host along with the replicas the
+// server copies them to, and the epoch of the ring they are routed with.
+type Route struct {
+	*Host
+	Replicas []string
+	Epoch    int64
 }
 
 func NewHost(addr string) *Host {
@@ -140,8 +152,20 @@ func (host *Host) executeWithTimeout(req *Request, timeout time.Duration) (resp
 	return
 }
 
+func (r *Route) executeWithTimeout(req *Request, timeout time.Duration) (*Response, error) {
+	if r.Replicas != nil {
+		req.Replicas = r.Replicas
+	}
+	if r.Epoch > 0 && isWrite(req.Cmd) {
+		req.Epoch = r.Epoch
+	}
+	return r.Host.executeWithTimeout(req, timeout)
+}
+
+// Get and GetMulti always ask for the cas unique, so that the proxy is
+// able to serve gets.
 func (host *Host) Get(key string) (*Item, error) {
-	req := &Request{Cmd: "get", Key: key}
+	req := &Request{Cmd: "gets", Keys: []string{key}}
 	resp, err := host.executeWithTimeout(req, ReadTimeout)
 	if err != nil {
 		return nil, err
@@ -150,14 +174,146 @@ func (host *Host) Get(key string) (*Item, error) {
 	return item, nil
 }
 
-func (host *Host) store(cmd string, key string, item *Item, noreply bool) (bool, error) {
-	req := &Request{Cmd: cmd, Key: key, Item: item, NoReply: noreply}
-	resp, err := host.executeWithTimeout(req, WriteTimeout)
-	return err == nil && resp.status == "STORED", err
+func (host *Host) GetMulti(keys []string) (map[string]*Item, error) {
+	req := &Request{Cmd: "gets", Keys: keys}
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.items, nil
+}
+
+// Fetch reads the copies of keys with everything a copy to another node
+// keeps: flag, exptime and cas unique.
+func (host *Host) Fetch(keys []string) (map[string]*Item, error) {
+	req := &Request{Cmd: "fetch", Keys: keys}
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return resp.items, nil
 }
 
+// The writes of a host go without replicas nor epoch, see Route.
+
 func (host *Host) Set(key string, item *Item, noreply bool) (bool, error) {
-	return host.store("set", key, item, noreply)
+	return (&Route{Host: host}).Set(key, item, noreply)
+}
+
+func (host *Host) Add(key string, item *Item, noreply bool) (bool, error) {
+	return (&Route{Host: host}).Add(key, item, noreply)
+}
+
+func (host *Host) Replace(key string, item *Item, noreply bool) (bool, error) {
+	return (&Route{Host: host}).Replace(key, item, noreply)
+}
+
+func (host *Host) Append(key string, item *Item, noreply bool) (bool, error) {
+	return (&Route{Host: host}).Append(key, item, noreply)
+}
+
+func (host *Host) Prepend(key string, item *Item, noreply bool) (bool, error) {
+	return (&Route{Host: host}).Prepend(key, item, noreply)
+}
+
+func (host *Host) Cas(key string, item *Item, noreply bool) (string, error) {
+	return (&Route{Host: host}).Cas(key, item, noreply)
+}
+
+func (host *Host) Incr(key string, delta int64, noreply bool) (uint64, bool, error) {
+	return (&Route{Host: host}).Incr(key, delta, noreply)
+}
+
+func (host *Host) Touch(key string, exptime int, noreply bool) (bool, error) {
+	return (&Route{Host: host}).Touch(key, exptime, noreply)
+}
+
+func (host *Host) Delete(key string) (bool, error) {
+	return (&Route{Host: host}).Delete(key)
+}
+
+func (r *Route) store(cmd string, key string, item *Item, noreply bool) (bool, error) {
+	req := &Request{Cmd: cmd, Keys: []string{key}, Item: item, NoReply: noreply}
+	resp, err := r.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	return err == nil && resp.status == "STORED", err
+}
+
+// Set sends a tombstone as a delete carrying its cas unique.
+func (r *Route) Set(key string, item *Item, noreply bool) (bool, error) {
+	if item.Deleted {
+		return r.delete(&Request{Cmd: "delete", Keys: []string{key}, Item: item, NoReply: noreply})
+	}
+	return r.store("set", key, item, noreply)
+}
+
+func (r *Route) Add(key string, item *Item, noreply bool) (bool, error) {
+	return r.store("add", key, item, noreply)
+}
+
+func (r *Route) Replace(key string, item *Item, noreply bool) (bool, error) {
+	return r.store("replace", key, item, noreply)
+}
+
+func (r *Route) Append(key string, item *Item, noreply bool) (bool, error) {
+	return r.store("append", key, item, noreply)
+}
+
+func (r *Route) Prepend(key string, item *Item, noreply bool) (bool, error) {
+	return r.store("prepend", key, item, noreply)
+}
+
+func (r *Route) Cas(key string, item *Item, noreply bool) (string, error) {
+	req := &Request{Cmd: "cas", Keys: []string{key}, Item: item, NoReply: noreply}
+	resp, err := r.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.status, nil
+}
+
+func (r *Route) Incr(key string, delta int64, noreply bool) (uint64, bool, error) {
+	req := &Request{Cmd: "incr", Keys: []string{key}, NoReply: noreply}
+	if delta < 0 {
+		req.Cmd = "decr"
+		delta = -delta
+	}
+	req.Item = &Item{Body: []byte(strconv.FormatInt(delta, 10))}
+	resp, err := r.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil || noreply || resp.status == "NOT_FOUND" {
+		return 0, err == nil && noreply, err
+	}
+	n, err := strconv.ParseUint(resp.status, 10, 64)
+	return n, err == nil, err
+}
+
+func (r *Route) Touch(key string, exptime int, noreply bool) (bool, error) {
+	req := &Request{Cmd: "touch", Keys: []string{key}, Item: &Item{Exptime: exptime}, NoReply: noreply}
+	resp, err := r.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	return err == nil && (noreply || resp.status == "TOUCHED"), err
+}
+
+func (r *Route) Delete(key string) (bool, error) {
+	return r.delete(&Request{Cmd: "delete", Keys: []string{key}})
+}
+
+func (r *Route) delete(req *Request) (bool, error) {
+	resp, err := r.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	return err == nil && (req.NoReply || resp.status == "DELETED"), err
 }
 
 func (host *Host) FlushAll() {
@@ -165,10 +321,43 @@ func (host *Host) FlushAll() {
 	host.execute(req)
 }
 
-func (host *Host) Delete(key string) (bool, error) {
-	req := &Request{Cmd: "delete", Key: key}
-	resp, err := host.execute(req)
-	return err == nil && resp.status == "DELETED", err
+// Ring pushes the ring of epoch to host, and returns the epoch of the ring
+// it keeps, which is newer if it already got one.
+func (host *Host) Ring(epoch int64, spec *RingSpec) (int64, error) {
+	req := &Request{Cmd: "ring", Keys: append([]string{strconv.FormatInt(epoch, 10)},
+		strings.Fields(spec.String())...)}
+	resp, err := host.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(resp.msg, 10, 64)
+}
+
+// Reclaim lets host drop the tombstones of ks older than cas, see
+// Reclaimer.
+func (host *Host) Reclaim(cas uint64, ks Keyspace) error {
+	req := &Request{Cmd: "reclaim", Keys: withKeyspace([]string{strconv.FormatUint(cas, 10)}, ks)}
+	resp, err := host.executeWithTimeout(req, WriteTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	return err
+}
+
+// Version is the heartbeat of the health checks.
+func (host *Host) Version() (string, error) {
+	req := &Request{Cmd: "version"}
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err != nil {
+		return "", err
+	}
+	if err = resp.err(); err != nil {
+		return "", err
+	}
+	return resp.msg, nil
 }
 
 func (host *Host) Stat() (map[string]string, error) {
@@ -184,9 +373,97 @@ func (host *Host) Stat() (map[string]string, error) {
 	return st, nil
 }
 
-func (host *Host) Migrate(addr string, left, right uint32) error {
-	_, e := host.Get(fmt.Sprintf("@#$%s-%d-%d", addr, left, right))
-	return e
+// Migrate asks host to copy the keys of ks in the ring range (left, right] to
+// addr, and returns the progress of the copy.
+func (host *Host) Migrate(addr string, left, right uint32, ks Keyspace) (*MigrateStatus, error) {
+	return host.migrate(&Request{Cmd: "migrate", Keys: withKeyspace([]string{addr,
+		strconv.FormatUint(uint64(left), 10), strconv.FormatUint(uint64(right), 10)}, ks)})
+}
+
+// MigrateStatus returns the progress of the copy id, nil if host does not
+// know it.
+func (host *Host) MigrateStatus(id string) (*MigrateStatus, error) {
+	return host.migrate(&Request{Cmd: "migrate_status", Keys: []string{id}})
+}
+
+func (host *Host) migrate(req *Request) (*MigrateStatus, error) {
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil || resp.status == "NOT_FOUND" {
+		return nil, err
+	}
+	return ParseMigrateStatus(resp.msg)
+}
+
+// merkleBatch bounds the nodes asked for in a request.
+const merkleBatch = 1000
+
+func joinInts(ns []int) string {
+	ss := make([]string, len(ns))
+	for i, n := range ns {
+		ss[i] = strconv.Itoa(n)
+	}
+	return strings.Join(ss, ",")
+}
+
+// Merkle returns the digests of nodes at a level of the Merkle tree of the
+// keys of ks on host.
+func (host *Host) Merkle(level int, nodes []int, ks Keyspace) ([]uint64, error) {
+	ds := make([]uint64, 0, len(nodes))
+	for len(nodes) > 0 {
+		n := len(nodes)
+		if n > merkleBatch {
+			n = merkleBatch
+		}
+		req := &Request{Cmd: "merkle", Keys: withKeyspace([]string{strconv.Itoa(level), joinInts(nodes[:n])}, ks)}
+		resp, err := host.executeWithTimeout(req, ReadTimeout)
+		if err == nil {
+			err = resp.err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		ss := strings.Split(resp.msg, ",")
+		if len(ss) != n {
+			return nil, errors.New("invalid merkle response")
+		}
+		for _, s := range ss {
+			d, err := strconv.ParseUint(s, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			ds = append(ds, d)
+		}
+		nodes = nodes[n:]
+	}
+	return ds, nil
+}
+
+// MerkleKeys returns the keys of ks on host under the leaves, with their cas
+// unique and exptime but no value, tombstones included.
+func (host *Host) MerkleKeys(leaves []int, ks Keyspace) (map[string]*Item, error) {
+	rs := make(map[string]*Item)
+	for len(leaves) > 0 {
+		n := len(leaves)
+		if n > merkleBatch {
+			n = merkleBatch
+		}
+		req := &Request{Cmd: "merkle_keys", Keys: withKeyspace([]string{joinInts(leaves[:n])}, ks)}
+		resp, err := host.executeWithTimeout(req, RepairTimeout)
+		if err == nil {
+			err = resp.err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		for key, item := range resp.items {
+			rs[key] = item
+		}
+		leaves = leaves[n:]
+	}
+	return rs, nil
 }
 
 func (host *Host) Len() int {
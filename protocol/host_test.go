@@ -1,9 +1,33 @@
 package protocol
 
 import (
+	"net"
 	"testing"
 )
 
+// freeAddr returns an address nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+// startServer serves store on a free port until the end of the test, and
+// returns its address.
+func startServer(t *testing.T, store Storage) string {
+	server := NewServer(store)
+	if err := server.Listen("localhost:0"); err != nil {
+		t.Fatal(err)
+	}
+	server.addr = server.l.Addr().String()
+	go server.Serve()
+	t.Cleanup(func() { server.l.Close() })
+	return server.addr
+}
+
 func TestHost(t *testing.T) {
 	store := NewMapStore()
 	server := NewServer(store)
@@ -18,4 +42,78 @@ func TestHost(t *testing.T) {
 	if e != nil {
 		t.Errorf("Get %s\n", e.Error())
 	}
+	host.Set("key2", &Item{Body: []byte{2}}, false)
+	items, e := host.GetMulti([]string{"key", "key2", "key3"})
+	if e != nil {
+		t.Errorf("GetMulti %s\n", e.Error())
+	}
+	if len(items) != 2 || items["key2"] == nil || items["key2"].Body[0] != 2 {
+		t.Errorf("GetMulti got %v\n", items)
+	}
+
+	host.Set("n", &Item{Body: []byte("10")}, false)
+	if n, ok, e := host.Incr("n", -3, false); e != nil || !ok || n != 7 {
+		t.Errorf("Incr got %d %t %v\n", n, ok, e)
+	}
+	host.Set("big", &Item{Body: []byte("18446744073709551614")}, false)
+	if n, ok, e := host.Incr("big", 1, false); e != nil || !ok || n != 1<<64-1 {
+		t.Errorf("Incr above MaxInt64 got %d %t %v\n", n, ok, e)
+	}
+	if _, ok, e := host.Incr("nokey", 1, false); e != nil || ok {
+		t.Errorf("Incr nokey got %t %v\n", ok, e)
+	}
+	if _, _, e := host.Incr("key", 1, false); e != ErrNotNumeric {
+		t.Errorf("Incr non-numeric got %v\n", e)
+	}
+	if ok, e := host.Add("n", &Item{Body: []byte("1")}, false); e != nil || ok {
+		t.Errorf("Add got %t %v\n", ok, e)
+	}
+	if ok, e := host.Touch("n", 100, false); e != nil || !ok {
+		t.Errorf("Touch got %t %v\n", ok, e)
+	}
+
+	item, _ := host.Get("n")
+	if item == nil || item.Cas == 0 {
+		t.Fatalf("Get cas got %v\n", item)
+	}
+	if st, e := host.Cas("n", &Item{Body: []byte("1"), Cas: item.Cas + 1}, false); e != nil || st != "EXISTS" {
+		t.Errorf("Cas got %s %v\n", st, e)
+	}
+	if st, e := host.Cas("n", &Item{Body: []byte("1"), Cas: item.Cas}, false); e != nil || st != "STORED" {
+		t.Errorf("Cas got %s %v\n", st, e)
+	}
+	if st, e := host.Cas("n", &Item{Body: []byte("2"), Cas: item.Cas}, false); e != nil || st != "EXISTS" {
+		t.Errorf("Cas got %s %v\n", st, e)
+	}
+}
+
+func TestHostExactCopy(t *testing.T) {
+	host := NewHost(startServer(t, NewMapStore()))
+
+	cas := NewCas()
+	copies := []struct {
+		body string
+		cas  uint64
+		want string
+	}{
+		{"b", cas, "b"},
+		{"a", cas - 1, "b"}, // older
+		{"a", cas, "b"},     // same version, smaller value
+		{"c", cas, "c"},
+		{"d", cas + 1, "d"},
+	}
+	for _, c := range copies {
+		if ok, e := host.Set("key", &Item{Body: []byte(c.body), Cas: c.cas}, false); !ok || e != nil {
+			t.Errorf("Set %s %d got %t %v\n", c.body, c.cas, ok, e)
+		}
+		if item, _ := host.Get("key"); item == nil || string(item.Body) != c.want {
+			t.Errorf("Set %s %d: got %v, expect %s\n", c.body, c.cas, item, c.want)
+		}
+	}
+	// a local write comes after the versions seen
+	host.Set("key", &Item{Body: []byte("e"), Cas: cas + 1e12}, false)
+	host.Set("key", &Item{Body: []byte("f")}, false)
+	if item, _ := host.Get("key"); item == nil || string(item.Body) != "f" {
+		t.Errorf("Set after a copy got %v\n", item)
+	}
 }
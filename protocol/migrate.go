@@ -0,0 +1,281 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// migrateTask copies the keys hashed into (left, right] from source to
+// target, left == right means the whole ring.
+type migrateTask struct {
+	source, target *Host
+	left, right    uint32
+}
+
+// lookup returns the ids of the first replicas distinct servers following
+// position h on the ring, the first one is the primary.
+func (c *Scheduler) lookup(h uint32, index []uint64) []int {
+	v := uint64(h) << 32
+	N := len(index)
+	i := sort.Search(N, func(k int) bool { return index[k] >= v })
+	ids := make([]int, 0, c.opts.Replicas)
+	for j := 0; j < N && len(ids) < c.opts.Replicas; j++ {
+		id := int(index[(i+j)%N] & 0xffffffff)
+		if !containInt(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// planMigration diffs two rings: the points of both cut the ring into
+// segments, and every server that replicates a segment in the new ring but
+// did not in the old one gets it copied from an old replica, preferably
+// one that stays in the ring.
+func (c *Scheduler) planMigration(hosts []*Host, index []uint64, hosts2 []*Host, index2 []uint64) []*migrateTask {
+	ps := make([]uint32, 0, len(index)+len(index2))
+	for _, v := range index {
+		ps = append(ps, uint32(v>>32))
+	}
+	for _, v := range index2 {
+		ps = append(ps, uint32(v>>32))
+	}
+	sort.Sort(uint32Slice(ps))
+	n := 0
+	for i, p := range ps {
+		if i == 0 || p != ps[n-1] {
+			ps[n] = p
+			n++
+		}
+	}
+	ps = ps[:n]
+
+	var tasks []*migrateTask
+	last := make(map[[2]*Host]*migrateTask)
+	for i, p := range ps {
+		left := ps[(i-1+n)%n]
+		var olds, news []*Host
+		for _, id := range c.lookup(p, index) {
+			olds = append(olds, hosts[id])
+		}
+		for _, id := range c.lookup(p, index2) {
+			news = append(news, hosts2[id])
+		}
+
+		source := olds[0]
+		for _, h := range olds {
+			if containHost(news, h) {
+				source = h
+				break
+			}
+		}
+		for _, target := range news {
+			if containHost(olds, target) {
+				continue
+			}
+			k := [2]*Host{source, target}
+			if t, ok := last[k]; ok && t.right == left {
+				t.right = p
+				continue
+			}
+			t := &migrateTask{source, target, left, p}
+			tasks = append(tasks, t)
+			last[k] = t
+		}
+	}
+	return tasks
+}
+
+var MigrateWorkers = 4
+var MigrateRetries = 3
+var MigratePollInterval time.Duration = time.Second
+
+// MigrationTask is the progress of a task, as last reported by its source.
+type MigrationTask struct {
+	Source, Target string
+	Left, Right    uint32
+	Tries          int
+	Err            string `json:",omitempty"` // of the last try
+	MigrateStatus
+}
+
+// Migration is the progress of moving the ring to Servers.
+type Migration struct {
+	ID         int
+	Servers    []string
+	Start, End time.Time
+	State      string // RUNNING, DONE or ABORTED
+	Err        string `json:",omitempty"`
+	Tasks      []MigrationTask
+}
+
+func (c *Scheduler) newMigration(addrs []string, tasks []*migrateTask) *Migration {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	c.migrations++
+	m := &Migration{ID: c.migrations, Servers: addrs, Start: time.Now(), State: "RUNNING"}
+	m.Tasks = make([]MigrationTask, len(tasks))
+	for i, t := range tasks {
+		m.Tasks[i] = MigrationTask{Source: t.source.Addr, Target: t.target.Addr,
+			Left: t.left, Right: t.right}
+	}
+	c.migration = m
+	return m
+}
+
+// skipCopied drops the tasks done by the last migration if it was to the
+// same servers and got interrupted while running, see Follow. The writes
+// went to the new ring all along, so the copied ranges are up to date.
+func (c *Scheduler) skipCopied(addrs []string, tasks []*migrateTask) []*migrateTask {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	last := c.migration
+	if last == nil || last.State != "RUNNING" || !SameAddrs(last.Servers, addrs) {
+		return tasks
+	}
+	done := make(map[string]bool)
+	for _, t := range last.Tasks {
+		if t.State == "DONE" {
+			done[fmt.Sprintf("%s %s %d %d", t.Source, t.Target, t.Left, t.Right)] = true
+		}
+	}
+	var rest []*migrateTask
+	for _, t := range tasks {
+		if !done[fmt.Sprintf("%s %s %d %d", t.source.Addr, t.target.Addr, t.left, t.right)] {
+			rest = append(rest, t)
+		}
+	}
+	log.Println("resume migration", last.ID, ":", len(tasks)-len(rest), "of", len(tasks), "ranges copied")
+	return rest
+}
+
+func (c *Scheduler) finishMigration(m *Migration, err error) {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	m.End = time.Now()
+	if err != nil {
+		m.State = "ABORTED"
+		m.Err = err.Error()
+	} else {
+		m.State = "DONE"
+	}
+}
+
+// Migration returns the progress of the last migration, nil if there was
+// none.
+func (c *Scheduler) Migration() *Migration {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if c.migration == nil {
+		return nil
+	}
+	m := *c.migration
+	m.Tasks = append([]MigrationTask(nil), m.Tasks...)
+	return &m
+}
+
+// runMigration copies the tasks with MigrateWorkers of them at a time,
+// retrying each one MigrateRetries times, and fails if any is not done.
+func (c *Scheduler) runMigration(m *Migration, tasks []*migrateTask) error {
+	log.Println("migration", m.ID, ":", len(tasks), "ranges")
+	ch := make(chan int)
+	errs := make(chan error, len(tasks))
+	var wg sync.WaitGroup
+	for i := 0; i < MigrateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				errs <- c.runTask(tasks[i], &m.Tasks[i])
+			}
+		}()
+	}
+	for i := range tasks {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	var err error
+	for e := range errs {
+		if e != nil {
+			failed++
+			err = e
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d ranges failed: %v", failed, len(tasks), err)
+	}
+	return nil
+}
+
+func (c *Scheduler) runTask(t *migrateTask, st *MigrationTask) (err error) {
+	for i := 0; i <= MigrateRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second << uint(i-1))
+		}
+		c.mlock.Lock()
+		st.Tries++
+		c.mlock.Unlock()
+		if err = c.waitTask(t, st); err == nil {
+			return nil
+		}
+		log.Println("migrate", t.source.Addr, "to", t.target.Addr, "failed:", err)
+		c.mlock.Lock()
+		st.Err = err.Error()
+		c.mlock.Unlock()
+	}
+	return fmt.Errorf("%s to %s (%d, %d]: %v", t.source.Addr, t.target.Addr, t.left, t.right, err)
+}
+
+// waitTask starts a task, or finds it still running after a failed try,
+// and polls it until its source finishes it.
+func (c *Scheduler) waitTask(t *migrateTask, st *MigrationTask) error {
+	s, err := t.source.Migrate(t.target.Addr, t.left, t.right, c.Keyspace())
+	for err == nil && s != nil {
+		c.mlock.Lock()
+		st.MigrateStatus = *s
+		c.mlock.Unlock()
+		switch s.State {
+		case "DONE":
+			return nil
+		case "FAILED":
+			return fmt.Errorf("%d keys not copied", s.Errors)
+		}
+		time.Sleep(MigratePollInterval)
+		s, err = t.source.MigrateStatus(s.ID)
+	}
+	if err == nil {
+		err = errors.New("migration lost")
+	}
+	return err
+}
+
+func containHost(hs []*Host, h *Host) bool {
+	for _, i := range hs {
+		if i == h {
+			return true
+		}
+	}
+	return false
+}
+
+type uint32Slice []uint32
+
+func (l uint32Slice) Len() int {
+	return len(l)
+}
+
+func (l uint32Slice) Less(i, j int) bool {
+	return l[i] < l[j]
+}
+
+func (l uint32Slice) Swap(i, j int) {
+	l[i], l[j] = l[j], l[i]
+}
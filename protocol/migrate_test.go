@@ -0,0 +1,270 @@
+package protocol
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func inTask(t *migrateTask, h uint32) bool {
+	if t.left < t.right {
+		return h > t.left && h <= t.right
+	}
+	return h > t.left || h <= t.right
+}
+
+// newRing returns the hosts and index of a ring with servers addrs2 which
+// shares the hosts of sch.
+func newRing(sch *Scheduler, addrs2 []string) ([]*Host, []uint64) {
+	hosts2 := make([]*Host, len(addrs2))
+	for i, addr := range addrs2 {
+		hosts2[i] = NewHost(addr)
+		for _, h := range sch.hosts {
+			if h.Addr == addr {
+				hosts2[i] = h
+			}
+		}
+	}
+	return hosts2, sch.buildIndex(addrs2)
+}
+
+// checkPlan verifies that every new replica of a key gets it from an old one.
+func checkPlan(t *testing.T, addrs, addrs2 []string, opts RingOptions) []*migrateTask {
+	sch := NewScheduler(addrs, opts)
+	hosts2, index2 := newRing(sch, addrs2)
+	tasks := sch.planMigration(sch.hosts, sch.index, hosts2, index2)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		h := sch.hash([]byte(key))
+		olds := sch.GetHostsByKey(key)
+		for _, id := range sch.getHostIndex(key, index2) {
+			n := hosts2[id]
+			found := containHost(olds, n)
+			for _, task := range tasks {
+				if task.target == n && inTask(task, h) && containHost(olds, task.source) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s is not copied to %s", key, n.Addr)
+			}
+		}
+	}
+	return tasks
+}
+
+func TestPlanMigrationRemove(t *testing.T) {
+	addrs := []string{"host1:7901", "host2:7901", "host3:7901", "host4:7901"}
+	tasks := checkPlan(t, addrs, []string{"host1:7901", "host2:7901", "host4:7901"},
+		RingOptions{Replicas: 2, VNodes: 10})
+	if len(tasks) == 0 {
+		t.Fatal("no task planned")
+	}
+	for _, task := range tasks {
+		if task.source == task.target || task.target.Addr == "host3:7901" {
+			t.Errorf("bad task %v", task)
+		}
+		if task.source.Addr == "host3:7901" {
+			t.Errorf("copy from the removed host while others have the data: %v", task)
+		}
+	}
+}
+
+func TestPlanMigrationAdd(t *testing.T) {
+	addrs := []string{"host1:7901", "host2:7901", "host3:7901"}
+	addrs2 := append(addrs, "host4:7901", "host5:7901")
+	tasks := checkPlan(t, addrs, addrs2, RingOptions{Replicas: 2, VNodes: 10})
+	targets := make(map[string]bool)
+	for _, task := range tasks {
+		targets[task.target.Addr] = true
+	}
+	if !targets["host4:7901"] || !targets["host5:7901"] || len(targets) != 2 {
+		t.Errorf("bad targets %v", targets)
+	}
+}
+
+func TestRunMigrationFail(t *testing.T) {
+	retries := MigrateRetries
+	MigrateRetries = 0
+	defer func() { MigrateRetries = retries }()
+
+	// nothing listens
+	addrs := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 1})
+	if err := sch.Update(addrs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && sch.Migrating(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if sch.Migrating() {
+		t.Fatal("migration not finished")
+	}
+	if n := len(sch.Servers()); n != 2 {
+		t.Errorf("ring swapped after failed migration: %d servers", n)
+	}
+	if m := sch.Migration(); m.State != "ABORTED" || m.Err == "" {
+		t.Errorf("bad migration %+v", m)
+	}
+}
+
+func TestRunMigrationResume(t *testing.T) {
+	retries := MigrateRetries
+	MigrateRetries = 0
+	defer func() { MigrateRetries = retries }()
+
+	// nothing listens, the interrupted migration copied all but one range
+	addrs := []string{freeAddr(t), freeAddr(t)}
+	addrs2 := append(addrs, freeAddr(t))
+	sch := NewScheduler(addrs, RingOptions{Replicas: 1, VNodes: 10})
+	hosts2, index2 := newRing(sch, addrs2)
+	tasks := sch.planMigration(sch.hosts, sch.index, hosts2, index2)
+	m := &Migration{ID: 7, Servers: addrs2, State: "RUNNING"}
+	for _, task := range tasks[1:] {
+		mt := MigrationTask{Source: task.source.Addr, Target: task.target.Addr,
+			Left: task.left, Right: task.right}
+		mt.State = "DONE"
+		m.Tasks = append(m.Tasks, mt)
+	}
+	if err := sch.Follow(&ClusterState{Ring: addrs, Migration: m}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sch.Update(addrs2); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && sch.Migrating(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	m2 := sch.Migration()
+	if m2.ID != 8 || len(m2.Tasks) != 1 || m2.Tasks[0].Left != tasks[0].left {
+		t.Errorf("resumed migration %+v", m2)
+	}
+}
+
+// fakeSource reports a migration RUNNING once, then DONE.
+type fakeSource struct {
+	*mapStore
+	lock  sync.Mutex
+	polls map[string]int
+}
+
+func (s *fakeSource) Migrate(addr string, left, right uint32, ks Keyspace) (*MigrateStatus, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id := fmt.Sprintf("%s-%d-%d", addr, left, right)
+	s.polls[id] = 0
+	return &MigrateStatus{ID: id, State: "RUNNING"}, nil
+}
+
+func (s *fakeSource) MigrateStatus(id string) *MigrateStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n, ok := s.polls[id]
+	if !ok {
+		return nil
+	}
+	s.polls[id]++
+	if n == 0 {
+		return &MigrateStatus{ID: id, State: "RUNNING", Scanned: 1}
+	}
+	return &MigrateStatus{ID: id, State: "DONE", Scanned: 2, Copied: 1, Bytes: 5}
+}
+
+func TestRunMigrationProgress(t *testing.T) {
+	interval := MigratePollInterval
+	MigratePollInterval = time.Millisecond
+	defer func() { MigratePollInterval = interval }()
+
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, &fakeSource{mapStore: NewMapStore(), polls: make(map[string]int)}))
+	}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 1})
+	if sch.Migration() != nil {
+		t.Fatal("migration before any update")
+	}
+	if err := sch.Update(addrs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && sch.Migrating(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	m := sch.Migration()
+	if m == nil || m.ID != 1 || m.State != "DONE" || len(m.Tasks) == 0 {
+		t.Fatalf("bad migration %+v", m)
+	}
+	for _, task := range m.Tasks {
+		if task.State != "DONE" || task.Copied != 1 || task.Bytes != 5 || task.Tries != 1 {
+			t.Errorf("bad task %+v", task)
+		}
+	}
+	if n := len(sch.Servers()); n != 3 {
+		t.Errorf("ring not swapped: %d servers", n)
+	}
+}
+
+// stuckSource fails its migrations once released.
+type stuckSource struct {
+	replicaStore
+	release chan bool
+}
+
+func (s stuckSource) Migrate(addr string, left, right uint32, ks Keyspace) (*MigrateStatus, error) {
+	return &MigrateStatus{ID: "1", State: "RUNNING"}, nil
+}
+
+func (s stuckSource) MigrateStatus(id string) *MigrateStatus {
+	select {
+	case <-s.release:
+		return &MigrateStatus{ID: id, State: "FAILED", Errors: 1}
+	default:
+		return &MigrateStatus{ID: id, State: "RUNNING"}
+	}
+}
+
+func TestRunMigrationAbortKeepsWrites(t *testing.T) {
+	retries, interval := MigrateRetries, MigratePollInterval
+	MigrateRetries, MigratePollInterval = 0, time.Millisecond
+	defer func() { MigrateRetries, MigratePollInterval = retries, interval }()
+
+	release := make(chan bool)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, stuckSource{replicaStore{NewMapStore()}, release}))
+	}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 1, VNodes: 10})
+	client := NewClient(sch)
+	if err := sch.Update(addrs); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if ok, e := client.Set(fmt.Sprintf("key%d", i), &Item{Body: []byte("v")}, false); !ok || e != nil {
+			t.Fatalf("Set while migrating got %t %v", ok, e)
+		}
+	}
+	close(release)
+	for i := 0; i < 100 && sch.Migrating(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if m := sch.Migration(); m.State != "ABORTED" || len(sch.Servers()) != 2 {
+		t.Fatalf("bad migration %+v", m)
+	}
+	for i := 0; i < 50; i++ {
+		if item, e := client.Get(fmt.Sprintf("key%d", i)); item == nil || e != nil {
+			t.Errorf("key%d lost by the aborted migration: %v", i, e)
+		}
+	}
+}
+
+func TestParseMigrateStatus(t *testing.T) {
+	st := &MigrateStatus{ID: "7", State: "FAILED", Scanned: 10, Copied: 8, Bytes: 100, Errors: 2}
+	r, err := ParseMigrateStatus(st.String())
+	if err != nil || *r != *st {
+		t.Errorf("parse %s: %v %v", st, r, err)
+	}
+	if _, err := ParseMigrateStatus("TRUST ME"); err == nil {
+		t.Error("parse invalid status")
+	}
+}
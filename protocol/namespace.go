@@ -0,0 +1,169 @@
+package protocol
+
+// Router is the store of a proxy which routes namespaces to their own
+// servers: a key "ns:..." of a routed namespace ns goes to the ring of ns,
+// the other keys to the default ring.
+type Router struct {
+	def        *Client
+	namespaces map[string]*Client
+}
+
+func NewRouter(def *Client) *Router {
+	return &Router{def: def, namespaces: make(map[string]*Client)}
+}
+
+// Route sends the keys of namespace ns to the servers of c, they are left
+// out of the keyspace of the default ring.
+func (r *Router) Route(ns string, c *Client) {
+	r.namespaces[ns] = c
+	c.sch.SetKeyspace(Keyspace{Only: ns})
+	ks := r.def.sch.Keyspace()
+	r.def.sch.SetKeyspace(Keyspace{Skip: append(ks.Skip, ns)})
+}
+
+// Namespace returns the namespace of key, empty if it is not routed.
+func (r *Router) Namespace(key string) string {
+	if ns := namespaceOf(key); ns != "" {
+		if _, ok := r.namespaces[ns]; ok {
+			return ns
+		}
+	}
+	return ""
+}
+
+func (r *Router) client(key string) *Client {
+	if ns := r.Namespace(key); ns != "" {
+		return r.namespaces[ns]
+	}
+	return r.def
+}
+
+func (r *Router) Get(key string) (*Item, error) {
+	return r.client(key).Get(key)
+}
+
+func (r *Router) GetMulti(keys []string) (map[string]*Item, error) {
+	groups := make(map[*Client][]string)
+	for _, key := range keys {
+		c := r.client(key)
+		groups[c] = append(groups[c], key)
+	}
+	if len(groups) == 1 {
+		return r.client(keys[0]).GetMulti(keys)
+	}
+	rs := make(map[string]*Item, len(keys))
+	var err error
+	for c, ks := range groups {
+		items, e := c.GetMulti(ks)
+		if e != nil {
+			err = e
+		}
+		for key, item := range items {
+			rs[key] = item
+		}
+	}
+	return rs, err
+}
+
+func (r *Router) Set(key string, item *Item, noreply bool) (bool, error) {
+	return r.client(key).Set(key, item, noreply)
+}
+
+func (r *Router) Add(key string, item *Item, noreply bool) (bool, error) {
+	return r.client(key).Add(key, item, noreply)
+}
+
+func (r *Router) Replace(key string, item *Item, noreply bool) (bool, error) {
+	return r.client(key).Replace(key, item, noreply)
+}
+
+func (r *Router) Append(key string, item *Item, noreply bool) (bool, error) {
+	return r.client(key).Append(key, item, noreply)
+}
+
+func (r *Router) Prepend(key string, item *Item, noreply bool) (bool, error) {
+	return r.client(key).Prepend(key, item, noreply)
+}
+
+func (r *Router) Cas(key string, item *Item, noreply bool) (string, error) {
+	return r.client(key).Cas(key, item, noreply)
+}
+
+func (r *Router) Incr(key string, delta int64, noreply bool) (uint64, bool, error) {
+	return r.client(key).Incr(key, delta, noreply)
+}
+
+func (r *Router) Touch(key string, exptime int, noreply bool) (bool, error) {
+	return r.client(key).Touch(key, exptime, noreply)
+}
+
+func (r *Router) Delete(key string) (bool, error) {
+	return r.client(key).Delete(key)
+}
+
+// Scan merges the pages of the rings, every ring listing the keys routed to
+// it only, like Client.Scan merges the pages of servers.
+func (r *Router) Scan(cursor, prefix string, limit int) ([]string, string, error) {
+	end := ""
+	page := NewScanPage(cursor, prefix, limit)
+	var keys [][]string
+	scan := func(ns string, c *Client) error {
+		ks, next, err := c.Scan(cursor, prefix, limit)
+		if err != nil {
+			return err
+		}
+		if next != "" && (end == "" || next < end) {
+			end = next
+		}
+		var own []string
+		for _, key := range ks {
+			if r.Namespace(key) == ns {
+				own = append(own, key)
+			}
+		}
+		keys = append(keys, own)
+		return nil
+	}
+	if err := scan("", r.def); err != nil {
+		return nil, "", err
+	}
+	for ns, c := range r.namespaces {
+		if err := scan(ns, c); err != nil {
+			return nil, "", err
+		}
+	}
+	for _, ks := range keys {
+		for _, key := range ks {
+			if end == "" || key <= end {
+				page.Add(key)
+			}
+		}
+	}
+	ks, next := page.Result()
+	if next == "" {
+		next = end
+	}
+	return ks, next, nil
+}
+
+func (r *Router) Len() int64 {
+	return 0
+}
+
+func (r *Router) FlushAll() {
+	r.def.FlushAll()
+	for _, c := range r.namespaces {
+		c.FlushAll()
+	}
+}
+
+// Stats adds up the stats of the clients of all rings.
+func (r *Router) Stats() map[string]int64 {
+	st := r.def.Stats()
+	for _, c := range r.namespaces {
+		for k, v := range c.Stats() {
+			st[k] += v
+		}
+	}
+	return st
+}
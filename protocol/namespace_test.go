@@ -0,0 +1,100 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRouter(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, NewMapStore()))
+	}
+	r := NewRouter(NewClient(NewScheduler(addrs[:2], RingOptions{Replicas: 1})))
+	r.Route("s", NewClient(NewScheduler(addrs[2:], RingOptions{Replicas: 1})))
+
+	for _, key := range []string{"s:1", "s:2", "x", "t:1"} {
+		if ok, e := r.Set(key, &Item{Body: []byte(key)}, false); !ok || e != nil {
+			t.Fatalf("Set %s got %t %v", key, ok, e)
+		}
+	}
+	// a copy of a routed key left on a server of the default ring
+	NewHost(addrs[0]).Set("s:9", &Item{Body: []byte("v")}, false)
+
+	ns := NewHost(addrs[2])
+	for _, key := range []string{"s:1", "s:2", "x", "t:1"} {
+		item, e := ns.Get(key)
+		if e != nil || (item != nil) != (key[0] == 's') {
+			t.Errorf("%s on %s got %v %v", key, ns.Addr, item, e)
+		}
+	}
+	items, e := r.GetMulti([]string{"s:1", "x", "t:1"})
+	if e != nil || len(items) != 3 {
+		t.Errorf("GetMulti got %v %v", items, e)
+	}
+	keys, next, e := r.Scan("", "", 10)
+	if e != nil || next != "" || fmt.Sprint(keys) != "[s:1 s:2 t:1 x]" {
+		t.Errorf("Scan got %v %q %v", keys, next, e)
+	}
+	if ok, e := r.Delete("s:1"); !ok || e != nil {
+		t.Errorf("Delete got %t %v", ok, e)
+	}
+	if item, e := ns.Get("s:1"); item != nil || e != nil {
+		t.Errorf("deleted s:1 got %v %v", item, e)
+	}
+}
+
+func TestKeyspace(t *testing.T) {
+	main := Keyspace{Skip: []string{"s", "t"}}
+	only := Keyspace{Only: "s"}
+	for key, in := range map[string][2]bool{"s:1": {false, true}, "t:1": {false, false},
+		"x": {true, false}, "u:1": {true, false}, "s": {true, false}} {
+		if main.Has(key) != in[0] || only.Has(key) != in[1] {
+			t.Errorf("%s in %v %v", key, main, only)
+		}
+	}
+	for _, ks := range []Keyspace{main, only, {}} {
+		if r, err := ParseKeyspace(ks.String()); err != nil || r.String() != ks.String() {
+			t.Errorf("parse %s got %v %v", ks, r, err)
+		}
+	}
+	for _, s := range []string{"", "+", "-", "s", "-s,", "+s:1", "+s,t"} {
+		if _, err := ParseKeyspace(s); err == nil {
+			t.Errorf("parse invalid keyspace %q", s)
+		}
+	}
+}
+
+// The repairs of the default ring leave alone the keys routed to another
+// ring on the same servers.
+func TestRepairSkipsRoutedKeys(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		addrs = append(addrs, startServer(t, merkleStore{NewMapStore(), HashMethods["crc32"], new(uint64)}))
+	}
+	def := NewClient(NewScheduler(addrs, RingOptions{Replicas: 2}))
+	r := NewRouter(def)
+	r.Route("s", NewClient(NewScheduler(addrs[:1], RingOptions{Replicas: 1})))
+	if ks := def.sch.Keyspace(); ks.String() != "-s" {
+		t.Fatalf("keyspace of the default ring %s", ks)
+	}
+	for _, key := range []string{"s:1", "s:2", "x"} {
+		NewHost(addrs[0]).Set(key, &Item{Body: []byte("v"), Cas: 1}, false)
+	}
+
+	if err := def.sch.StartRepair(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && def.sch.Repair().State == "RUNNING"; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if rp := def.sch.Repair(); rp.State != "DONE" || rp.Repaired != 1 {
+		t.Errorf("bad repair %+v", rp)
+	}
+	for key, copied := range map[string]bool{"s:1": false, "s:2": false, "x": true} {
+		if item, _ := NewHost(addrs[1]).Get(key); (item != nil) != copied {
+			t.Errorf("%s on %s: %v", key, addrs[1], item)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrefixDelete is the progress of deleting the keys starting with Prefix on
+// all servers. They are replaced by tombstones of the same version Cas on
+// every replica, the keys written after the start are kept.
+type PrefixDelete struct {
+	ID         int
+	Prefix     string
+	Cas        uint64
+	Start, End time.Time
+	State      string // RUNNING, DONE or FAILED
+	Err        string `json:",omitempty"`
+	Servers    map[string]*PrefixStatus
+	Scanned    int64 // of all servers
+	Deleted    int64
+	Errors     int64
+}
+
+// DeletePrefix asks host to delete the keys of ks starting with prefix older
+// than cas, and returns the progress.
+func (host *Host) DeletePrefix(prefix string, cas uint64, ks Keyspace) (*PrefixStatus, error) {
+	return host.deletePrefix(&Request{Cmd: "delete_prefix",
+		Keys: withKeyspace([]string{prefix, strconv.FormatUint(cas, 10)}, ks)})
+}
+
+// DeletePrefixStatus returns the progress of the job id, nil if host does
+// not know it.
+func (host *Host) DeletePrefixStatus(id string) (*PrefixStatus, error) {
+	return host.deletePrefix(&Request{Cmd: "delete_prefix_status", Keys: []string{id}})
+}
+
+func (host *Host) deletePrefix(req *Request) (*PrefixStatus, error) {
+	resp, err := host.executeWithTimeout(req, ReadTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil || resp.status == "NOT_FOUND" {
+		return nil, err
+	}
+	return ParsePrefixStatus(resp.msg)
+}
+
+// StartDeletePrefix deletes the keys starting with prefix on all servers in
+// the background.
+func (c *Scheduler) StartDeletePrefix(prefix string) error {
+	if prefix == "" || len(prefix) > MaxKeyLength || strings.ContainsAny(prefix, " \t\r\n") {
+		return errors.New("invalid prefix")
+	}
+	c.RLock()
+	hosts, migrating := c.allHosts(), c.IsMegrating
+	c.RUnlock()
+	if migrating {
+		// a range copied after its source is done would bring keys back
+		return errors.New("migration in progress")
+	}
+
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if c.prefixDelete != nil && c.prefixDelete.State == "RUNNING" {
+		return errors.New("delete prefix in progress")
+	}
+	c.prefixDeletes++
+	d := &PrefixDelete{ID: c.prefixDeletes, Prefix: prefix, Cas: NewCas(),
+		Start: time.Now(), State: "RUNNING", Servers: make(map[string]*PrefixStatus)}
+	for _, h := range hosts {
+		d.Servers[h.Addr] = &PrefixStatus{State: "RUNNING"}
+	}
+	c.prefixDelete = d
+	go c.runDeletePrefix(d, hosts)
+	return nil
+}
+
+// PrefixDelete returns the progress of the last delete prefix, nil if there
+// was none.
+func (c *Scheduler) PrefixDelete() *PrefixDelete {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if c.prefixDelete == nil {
+		return nil
+	}
+	d := *c.prefixDelete
+	d.Servers = make(map[string]*PrefixStatus, len(c.prefixDelete.Servers))
+	for addr, st := range c.prefixDelete.Servers {
+		s := *st
+		d.Servers[addr] = &s
+	}
+	return &d
+}
+
+func (c *Scheduler) runDeletePrefix(d *PrefixDelete, hosts []*Host) {
+	log.Println("delete prefix", d.ID, d.Prefix, "on", len(hosts), "servers")
+	errs := make(chan error, len(hosts))
+	var wg sync.WaitGroup
+	for _, h := range hosts {
+		wg.Add(1)
+		go func(h *Host) {
+			defer wg.Done()
+			errs <- c.deletePrefixOn(d, h)
+		}(h)
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	var err error
+	for e := range errs {
+		if e != nil {
+			failed++
+			err = e
+		}
+	}
+
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	d.End = time.Now()
+	d.State = "DONE"
+	if failed > 0 {
+		d.State = "FAILED"
+		d.Err = fmt.Sprintf("%d of %d servers failed: %v", failed, len(hosts), err)
+	}
+	log.Println("delete prefix", d.ID, d.State, ":", d.Deleted, "keys deleted")
+}
+
+// deletePrefixOn runs the delete on h, retried like a migration task.
+func (c *Scheduler) deletePrefixOn(d *PrefixDelete, h *Host) (err error) {
+	for i := 0; i <= MigrateRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Second << uint(i-1))
+		}
+		if err = c.waitDeletePrefix(d, h); err == nil {
+			return nil
+		}
+		log.Println("delete prefix", d.Prefix, "on", h.Addr, "failed:", err)
+	}
+	return fmt.Errorf("%s : %v", h.Addr, err)
+}
+
+// waitDeletePrefix starts the job on h, or finds it still running after a
+// failed try, and polls it until it is finished.
+func (c *Scheduler) waitDeletePrefix(d *PrefixDelete, h *Host) error {
+	s, err := h.DeletePrefix(d.Prefix, d.Cas, c.Keyspace())
+	for err == nil && s != nil {
+		c.mlock.Lock()
+		old := d.Servers[h.Addr]
+		d.Scanned += s.Scanned - old.Scanned
+		d.Deleted += s.Deleted - old.Deleted
+		d.Errors += s.Errors - old.Errors
+		d.Servers[h.Addr] = s
+		c.mlock.Unlock()
+		switch s.State {
+		case "DONE":
+			return nil
+		case "FAILED":
+			return fmt.Errorf("%d keys not deleted", s.Errors)
+		}
+		time.Sleep(MigratePollInterval)
+		s, err = h.DeletePrefixStatus(s.ID)
+	}
+	if err == nil {
+		err = errors.New("delete prefix lost")
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// prefixStore deletes a prefix at once.
+type prefixStore struct {
+	*mapStore
+}
+
+func (s prefixStore) DeletePrefix(prefix string, cas uint64, ks Keyspace) (*PrefixStatus, error) {
+	st := &PrefixStatus{ID: "1", State: "DONE"}
+	s.lock.Lock()
+	var keys []string
+	for key, item := range s.data {
+		st.Scanned++
+		if strings.HasPrefix(key, prefix) && ks.Has(key) && !item.Deleted && item.Cas < cas {
+			keys = append(keys, key)
+		}
+	}
+	s.lock.Unlock()
+	for _, key := range keys {
+		s.DeleteCopy(key, cas)
+		st.Deleted++
+	}
+	return st, nil
+}
+
+func (s prefixStore) DeletePrefixStatus(id string) *PrefixStatus {
+	return nil
+}
+
+func TestDeletePrefix(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		addrs = append(addrs, startServer(t, prefixStore{NewMapStore()}))
+	}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 2})
+	client := NewClient(sch)
+	for _, key := range []string{"s:1", "s:2", "s:3", "t:1"} {
+		client.setQuorum(key, &Item{Body: []byte("v")})
+	}
+
+	if err := sch.StartDeletePrefix("s :"); err == nil {
+		t.Error("invalid prefix accepted")
+	}
+	if sch.PrefixDelete() != nil {
+		t.Fatal("delete prefix before any start")
+	}
+	if err := sch.StartDeletePrefix("s:"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && sch.PrefixDelete().State == "RUNNING"; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	d := sch.PrefixDelete()
+	if d.State != "DONE" || d.Deleted != 6 || d.Scanned != 8 || len(d.Servers) != 2 {
+		t.Errorf("bad delete prefix %+v", d)
+	}
+	for _, h := range sch.hosts {
+		for i, key := range []string{"s:1", "s:2", "s:3", "t:1"} {
+			item, e := h.Get(key)
+			if e != nil || (item == nil) != (i < 3) {
+				t.Errorf("%s on %s: %v %v", key, h.Addr, item, e)
+			}
+		}
+	}
+}
+
+func TestParsePrefixStatus(t *testing.T) {
+	st := &PrefixStatus{ID: "7", State: "FAILED", Scanned: 10, Deleted: 8, Errors: 2}
+	r, err := ParsePrefixStatus(st.String())
+	if err != nil || *r != *st {
+		t.Errorf("parse %s: %v %v", st, r, err)
+	}
+	if _, err := ParsePrefixStatus("TRUST ME"); err == nil {
+		t.Error("parse invalid status")
+	}
+}
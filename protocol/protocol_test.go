@@ -23,27 +23,223 @@ var reqTests = []reqTest{
 		"CLIENT_ERROR key too long\r\n",
 	},
 	reqTest{
-		"set cdf 2\r\nok\r\n",
+		"set cdf 0 0 2\r\nok\r\n",
 		"STORED\r\n",
 	},
 	reqTest{
 		"get cdf\r\n",
-		"VALUE cdf 2\r\nok\r\nEND\r\n",
+		"VALUE cdf 0 2\r\nok\r\nEND\r\n",
 	},
 	reqTest{
-		"set abc 1\r\nd\r\n",
+		"get cdf nokey\r\n",
+		"VALUE cdf 0 2\r\nok\r\nEND\r\n",
+	},
+	reqTest{
+		"get nokey " + strings.Repeat("a", 300) + "\r\n",
+		"CLIENT_ERROR key too long\r\n",
+	},
+	reqTest{
+		"set abc 0 0 1\r\nd\r\n",
 		"STORED\r\n",
 	},
 	reqTest{
 		"delete abc\r\n",
 		"DELETED\r\n",
 	},
+	reqTest{
+		"delete abc\r\n",
+		"NOT_FOUND\r\n",
+	},
+	reqTest{
+		"set abc 0 0 1 7\r\nd\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"get abc\r\n",
+		"END\r\n",
+	},
+	reqTest{
+		"delete cdf 7\r\n",
+		"DELETED\r\n",
+	},
+	reqTest{
+		"get cdf\r\n",
+		"VALUE cdf 0 2\r\nok\r\nEND\r\n",
+	},
+	reqTest{
+		"set abc 0 0 1\r\nd\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"delete abc 0\r\n",
+		"DELETED\r\n",
+	},
+	reqTest{
+		"get abc\r\n",
+		"END\r\n",
+	},
 
 	reqTest{
-		"set n 1\r\n5\r\n",
+		"set n 0 0 1\r\n5\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"set f 12 3600 2\r\nok\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"get f\r\n",
+		"VALUE f 12 2\r\nok\r\nEND\r\n",
+	},
+	reqTest{
+		"set e 0 -1 2\r\nok\r\n",
 		"STORED\r\n",
 	},
+	reqTest{
+		"get e\r\n",
+		"END\r\n",
+	},
+	reqTest{
+		"set n 2\r\nok\r\n",
+		"CLIENT_ERROR invalid cmd\r\n",
+	},
 
+	reqTest{
+		"add n 0 0 1\r\n6\r\n",
+		"NOT_STORED\r\n",
+	},
+	reqTest{
+		"add m 0 0 1\r\n6\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"replace x 0 0 1\r\n6\r\n",
+		"NOT_STORED\r\n",
+	},
+	reqTest{
+		"replace m 3 0 2\r\n10\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"incr m 5\r\n",
+		"15\r\n",
+	},
+	reqTest{
+		"decr m 20\r\n",
+		"0\r\n",
+	},
+	reqTest{
+		"incr x 1\r\n",
+		"NOT_FOUND\r\n",
+	},
+	reqTest{
+		"incr m abc\r\n",
+		"CLIENT_ERROR invalid numeric delta argument\r\n",
+	},
+	reqTest{
+		"append m 0 0 1\r\n9\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"prepend m 0 0 1\r\n8\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"get m\r\n",
+		"VALUE m 3 3\r\n809\r\nEND\r\n",
+	},
+	reqTest{
+		"append f 0 0 1\r\n!\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"incr f 1\r\n",
+		"CLIENT_ERROR cannot increment or decrement non-numeric value\r\n",
+	},
+	reqTest{
+		"touch m -1\r\n",
+		"TOUCHED\r\n",
+	},
+	reqTest{
+		"touch m 0\r\n",
+		"NOT_FOUND\r\n",
+	},
+	reqTest{
+		"delete m noreply\r\n",
+		"",
+	},
+	reqTest{
+		"cas nokey 0 0 1 1\r\nx\r\n",
+		"NOT_FOUND\r\n",
+	},
+	reqTest{
+		"cas cdf 0 0 1 1\r\nx\r\n",
+		"EXISTS\r\n",
+	},
+	reqTest{
+		"cas cdf 0 0 1\r\nx\r\n",
+		"CLIENT_ERROR invalid cmd\r\n",
+	},
+	reqTest{
+		"replicate host2:7901 set r 0 0 1\r\nx\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"get r\r\n",
+		"VALUE r 0 1\r\nx\r\nEND\r\n",
+	},
+	reqTest{
+		"replicate host2:7901 get r\r\n",
+		"CLIENT_ERROR invalid cmd\r\n",
+	},
+	reqTest{
+		"epoch 3 replicate host2:7901 set r 0 0 1\r\ny\r\n",
+		"STORED\r\n",
+	},
+	reqTest{
+		"epoch 3 get r\r\n",
+		"CLIENT_ERROR invalid cmd\r\n",
+	},
+	reqTest{
+		"scan 0 1 r\r\n",
+		"KEY r\r\nSCAN 0\r\n",
+	},
+	reqTest{
+		"scan 72 5\r\n",
+		"SCAN 0\r\n",
+	},
+	reqTest{
+		"scan 0 0\r\n",
+		"CLIENT_ERROR invalid limit\r\n",
+	},
+	reqTest{
+		"scan r 1\r\n",
+		"CLIENT_ERROR invalid cursor\r\n",
+	},
+	reqTest{
+		"ring 3 host1:7901 1 1 crc32 host1:7901\r\n",
+		"SERVER_ERROR not supported\r\n",
+	},
+	reqTest{
+		"migrate host2:7901 0 100\r\n",
+		"SERVER_ERROR not supported\r\n",
+	},
+	reqTest{
+		"migrate host2:7901 0 x\r\n",
+		"CLIENT_ERROR strconv.ParseUint: parsing \"x\": invalid syntax\r\n",
+	},
+	reqTest{
+		"delete_prefix s: 5\r\n",
+		"SERVER_ERROR not supported\r\n",
+	},
+	reqTest{
+		"delete_prefix s: 0\r\n",
+		"CLIENT_ERROR invalid cas\r\n",
+	},
+	reqTest{
+		"migrate_status\r\n",
+		"CLIENT_ERROR invalid cmd\r\n",
+	},
 	reqTest{
 		"quit\r\n",
 		"",
@@ -82,3 +278,29 @@ func TestRequest(t *testing.T) {
 		}
 	}
 }
+
+// plainStore keeps no versions, like the proxy.
+type plainStore struct {
+	Storage
+}
+
+func TestCopyRefused(t *testing.T) {
+	cmd := "set k 0 0 1 99999999999999999\r\nv\r\n"
+	for _, test := range []struct {
+		store  Storage
+		anwser string
+	}{
+		{plainStore{NewMapStore()}, "CLIENT_ERROR copies are only accepted by data nodes\r\n"},
+		{NewMapStore(), "STORED\r\n"},
+	} {
+		req := new(Request)
+		if e := req.Read(bufio.NewReader(bytes.NewBufferString(cmd))); e != nil {
+			t.Fatal(e)
+		}
+		var w bytes.Buffer
+		req.Process(test.store, NewStats()).Write(&w)
+		if w.String() != test.anwser {
+			t.Errorf("copy to %T got %q", test.store, w.String())
+		}
+	}
+}
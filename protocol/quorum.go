@@ -0,0 +1,294 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Consistency is the number of replicas that have to answer a request.
+type Consistency int
+
+const (
+	ONE Consistency = iota
+	QUORUM
+	ALL
+)
+
+func ParseConsistency(s string) (Consistency, error) {
+	switch s {
+	case "ONE", "one":
+		return ONE, nil
+	case "QUORUM", "quorum":
+		return QUORUM, nil
+	case "ALL", "all":
+		return ALL, nil
+	}
+	return ONE, errors.New("unknown consistency level: " + s)
+}
+
+func (l Consistency) String() string {
+	return []string{"ONE", "QUORUM", "ALL"}[l]
+}
+
+// count returns how many of n replicas are needed.
+func (l Consistency) count(n int) int {
+	switch l {
+	case QUORUM:
+		return n/2 + 1
+	case ALL:
+		return n
+	}
+	return 1
+}
+
+// getQuorum fetches key from all replicas in parallel and returns the
+// freshest copy once enough of them answered, a miss counts as an answer.
+// A tombstone or an expired copy is a version too, which reads as a miss
+// when it is the freshest. With read repair it waits for all of them, and
+// the replicas which missed the freshest copy get it in background, with
+// its exptime.
+func (c *Client) getQuorum(key string) (*Item, error) {
+	hosts := c.sch.GetHostsByKey(key)
+	need := c.ReadLevel.count(len(hosts))
+	wait := need
+	if c.ReadRepair {
+		wait = len(hosts)
+	}
+	type result struct {
+		host *Host
+		item *Item
+		err  error
+	}
+	rs := make(chan result, len(hosts))
+	for _, h := range hosts {
+		go func(h *Host) {
+			items, err := h.Fetch([]string{key})
+			if err != nil {
+				err = fmt.Errorf("%s : %s", h.Addr, err.Error())
+			}
+			rs <- result{h, items[key], err}
+		}(h)
+	}
+
+	var item *Item
+	var err error
+	answers := make(map[*Host]*Item, len(hosts))
+	for i := 0; i < len(hosts) && len(answers) < wait; i++ {
+		r := <-rs
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		answers[r.host] = r.item
+		if Newer(r.item, item) {
+			item = r.item
+		}
+	}
+	if len(answers) < need {
+		return nil, fmt.Errorf("read quorum not reached, %d of %d: %v", len(answers), need, err)
+	}
+	if c.ReadRepair {
+		c.repairRead(key, item, answers)
+	}
+	return live(item), nil
+}
+
+// live returns item unless it reads as a miss.
+func live(item *Item) *Item {
+	if item == nil || item.Deleted || item.Expired() {
+		return nil
+	}
+	return item
+}
+
+// repairRead writes item back to the hosts which answered an older copy or
+// a miss, a tombstone is copied as a delete.
+func (c *Client) repairRead(key string, item *Item, answers map[*Host]*Item) {
+	if item == nil {
+		return
+	}
+	var stale []*Host
+	for h, it := range answers {
+		if Newer(item, it) {
+			stale = append(stale, h)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	// the body of item is freed once it is sent to the client
+	it := &Item{Body: make([]byte, len(item.Body)), Flag: item.Flag,
+		Exptime: item.Exptime, Cas: item.Cas, Deleted: item.Deleted}
+	copy(it.Body, item.Body)
+	go func() {
+		for _, h := range stale {
+			if ok, err := h.Set(key, it, false); err != nil || !ok {
+				atomic.AddInt64(&c.readRepairErrors, 1)
+			} else {
+				atomic.AddInt64(&c.readRepairs, 1)
+			}
+		}
+	}()
+}
+
+// getMultiQuorum fetches from every replica of every key, one request per
+// host, and keeps the freshest copy of each key answered by enough replicas,
+// leaving out the keys it is a tombstone or an expired copy of.
+func (c *Client) getMultiQuorum(keys []string) (map[string]*Item, error) {
+	groups := make(map[*Host][]string)
+	needs := make(map[string]int, len(keys))
+	for _, key := range keys {
+		hosts := c.sch.GetHostsByKey(key)
+		for _, h := range hosts {
+			groups[h] = append(groups[h], key)
+		}
+		needs[key] = c.ReadLevel.count(len(hosts))
+	}
+
+	var lock sync.Mutex
+	acks := make(map[string]int, len(keys))
+	rs := make(map[string]*Item, len(keys))
+	answers := make(map[*Host]map[string]*Item, len(groups))
+	var err error
+	var wg sync.WaitGroup
+	for h, ks := range groups {
+		wg.Add(1)
+		go func(h *Host, ks []string) {
+			defer wg.Done()
+			r, e := h.Fetch(ks)
+			lock.Lock()
+			defer lock.Unlock()
+			if e != nil {
+				err = fmt.Errorf("%s : %s", h.Addr, e.Error())
+				return
+			}
+			answers[h] = r
+			for _, key := range ks {
+				acks[key]++
+				if item := r[key]; Newer(item, rs[key]) {
+					rs[key] = item
+				}
+			}
+		}(h, ks)
+	}
+	wg.Wait()
+
+	if c.ReadRepair {
+		for _, key := range keys {
+			as := make(map[*Host]*Item)
+			for h, r := range answers {
+				if contain(groups[h], key) {
+					as[h] = r[key]
+				}
+			}
+			c.repairRead(key, rs[key], as)
+		}
+	}
+
+	for key, item := range rs {
+		if live(item) == nil {
+			delete(rs, key)
+		}
+	}
+	for _, key := range keys {
+		if acks[key] < needs[key] {
+			return rs, fmt.Errorf("read quorum not reached for %s, %d of %d: %v",
+				key, acks[key], needs[key], err)
+		}
+	}
+	return rs, nil
+}
+
+// copyTo writes item to hosts in parallel, keeping its cas unique, and
+// returns how many of them stored it.
+func (c *Client) copyTo(hosts []*Route, key string, item *Item) (int, error) {
+	oks := make(chan error, len(hosts))
+	for _, h := range hosts {
+		go func(h *Route) {
+			ok, e := h.Set(key, item, false)
+			if c.moved(e) || e != nil {
+				e = fmt.Errorf("%s : %s", h.Addr, e.Error())
+			} else if !ok {
+				e = fmt.Errorf("%s : not stored", h.Addr)
+			}
+			oks <- e
+		}(h)
+	}
+	acks := 0
+	var err error
+	for i := 0; i < len(hosts); i++ {
+		if e := <-oks; e != nil {
+			err = e
+		} else {
+			acks++
+		}
+	}
+	return acks, err
+}
+
+// setQuorum stamps item with a new cas unique and stores the same copy on
+// all replicas in parallel.
+func (c *Client) setQuorum(key string, item *Item) (bool, error) {
+	hosts := c.getWriteHosts(key)
+	need := c.WriteLevel.count(len(hosts))
+	it := *item
+	it.Cas = NewCas()
+	acks, err := c.copyTo(hosts, key, &it)
+	if acks < need {
+		return acks > 0, fmt.Errorf("write quorum not reached, %d of %d: %v", acks, need, err)
+	}
+	return true, nil
+}
+
+// deleteQuorum stores the same tombstone on all replicas in parallel. It
+// does not tell whether key was there.
+func (c *Client) deleteQuorum(key string) (bool, error) {
+	hosts := c.getWriteHosts(key)
+	need := c.WriteLevel.count(len(hosts))
+	acks, err := c.copyTo(hosts, key, &Item{Cas: NewCas(), Deleted: true})
+	if acks < need {
+		return acks > 0, fmt.Errorf("write quorum not reached, %d of %d: %v", acks, need, err)
+	}
+	return true, nil
+}
+
+// writeQuorum applies a conditional write on the first replica that
+// accepts it, then reads the new version back with its exptime and copies
+// it to the other replicas in parallel.
+func (c *Client) writeQuorum(key string, op func(h *Route, key string) (bool, error)) (bool, error) {
+	hosts := c.getWriteHosts(key)
+	need := c.WriteLevel.count(len(hosts))
+	var err error
+	for i, h := range hosts {
+		ok, e := op(h, key)
+		if e == ErrNotNumeric || e == nil && !ok {
+			return ok, e
+		}
+		if e != nil {
+			err = fmt.Errorf("%s : %s", h.Addr, e.Error())
+			continue
+		}
+
+		acks := 1
+		items, e := h.Fetch([]string{key})
+		item := items[key]
+		if e != nil || item == nil {
+			err = fmt.Errorf("%s : read back failed", h.Addr)
+		} else {
+			others := make([]*Route, 0, len(hosts)-1)
+			others = append(append(others, hosts[:i]...), hosts[i+1:]...)
+			n, e := c.copyTo(others, key, item)
+			acks += n
+			if e != nil {
+				err = e
+			}
+		}
+		if acks < need {
+			return true, fmt.Errorf("write quorum not reached, %d of %d: %v", acks, need, err)
+		}
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,278 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// the keys of leaves are listed by scanning all keys of a server
+var RepairTimeout time.Duration = time.Minute
+
+// Repair is the progress of comparing the replicas of the ring.
+type Repair struct {
+	ID         int
+	Start, End time.Time
+	State      string // RUNNING, DONE or FAILED
+	Err        string `json:",omitempty"`
+	Pairs      int    // pairs of servers sharing ranges
+	Nodes      int64  // tree nodes compared
+	Leaves     int64  // leaves which differ
+	Keys       int64  // keys which differ
+	Repaired   int64  // keys copied
+	Errors     int64
+}
+
+// span is a closed interval of ring positions.
+type span struct {
+	lo, hi uint64
+}
+
+// StartRepair compares the Merkle trees of every pair of servers sharing
+// ranges in the background, and copies the newer version of the keys which
+// differ to the other server.
+func (c *Scheduler) StartRepair() error {
+	c.RLock()
+	hosts, index, migrating := c.hosts, c.index, c.IsMegrating
+	c.RUnlock()
+	if migrating {
+		return errors.New("migration in progress")
+	}
+
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if c.repair != nil && c.repair.State == "RUNNING" {
+		return errors.New("repair in progress")
+	}
+	c.repairs++
+	r := &Repair{ID: c.repairs, Start: time.Now(), State: "RUNNING"}
+	c.repair = r
+	go c.runRepair(r, hosts, index, NewCas())
+	return nil
+}
+
+// Repair returns the progress of the last repair, nil if there was none.
+func (c *Scheduler) Repair() *Repair {
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	if c.repair == nil {
+		return nil
+	}
+	r := *c.repair
+	return &r
+}
+
+// runRepair lets the servers drop the tombstones older than since, the
+// start of the repair, once it found and copied all differences.
+func (c *Scheduler) runRepair(r *Repair, hosts []*Host, index []uint64, since uint64) {
+	pairs := c.sharedRanges(index)
+	var keys [][2]int
+	for a := range hosts {
+		for b := a + 1; b < len(hosts); b++ {
+			if _, ok := pairs[[2]int{a, b}]; ok {
+				keys = append(keys, [2]int{a, b})
+			}
+		}
+	}
+	log.Println("repair", r.ID, ":", len(keys), "pairs")
+
+	c.mlock.Lock()
+	r.Pairs = len(keys)
+	c.mlock.Unlock()
+	var err error
+	for _, k := range keys {
+		if e := c.repairPair(r, hosts, index, k[0], k[1], pairs[k]); e != nil {
+			log.Println("repair", hosts[k[0]].Addr, hosts[k[1]].Addr, "failed:", e)
+			err = e
+		}
+	}
+
+	c.mlock.Lock()
+	clean := err == nil && r.Errors == 0
+	c.mlock.Unlock()
+	if clean {
+		for _, h := range hosts {
+			if e := h.Reclaim(since, c.Keyspace()); e != nil {
+				log.Println("reclaim on", h.Addr, "failed:", e)
+			}
+		}
+	}
+
+	c.mlock.Lock()
+	defer c.mlock.Unlock()
+	r.End = time.Now()
+	r.State = "DONE"
+	if err != nil {
+		r.State = "FAILED"
+		r.Err = err.Error()
+	}
+	log.Println("repair", r.ID, r.State, ":", r.Keys, "keys differ,", r.Repaired, "repaired")
+}
+
+// sharedRanges returns the ranges of the ring replicated by every pair of
+// servers, by server ids.
+func (c *Scheduler) sharedRanges(index []uint64) map[[2]int][]span {
+	var ps []uint32
+	for _, v := range index {
+		if p := uint32(v >> 32); len(ps) == 0 || p != ps[len(ps)-1] {
+			ps = append(ps, p)
+		}
+	}
+	pairs := make(map[[2]int][]span)
+	for i, p := range ps {
+		left := ps[(i-1+len(ps))%len(ps)]
+		var spans []span
+		switch {
+		case len(ps) == 1:
+			spans = []span{{0, 1<<32 - 1}}
+		case left < p:
+			spans = []span{{uint64(left) + 1, uint64(p)}}
+		default:
+			spans = []span{{0, uint64(p)}}
+			if left < 1<<32-1 {
+				spans = append(spans, span{uint64(left) + 1, 1<<32 - 1})
+			}
+		}
+		ids := c.lookup(p, index)
+		for x := range ids {
+			for y := range ids {
+				if ids[x] < ids[y] {
+					k := [2]int{ids[x], ids[y]}
+					pairs[k] = append(pairs[k], spans...)
+				}
+			}
+		}
+	}
+	return pairs
+}
+
+// overlaps tells whether a node of the tree covers a position in spans.
+func overlaps(level, node int, spans []span) bool {
+	size := uint64(1) << uint(32-level)
+	lo := uint64(node) * size
+	hi := lo + size - 1
+	for _, s := range spans {
+		if s.lo <= hi && lo <= s.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// repairPair walks down the trees of servers a and b through the nodes
+// which differ, and repairs the keys of the leaves which differ.
+func (c *Scheduler) repairPair(r *Repair, hosts []*Host, index []uint64, a, b int, spans []span) error {
+	ks := c.Keyspace()
+	nodes := []int{0}
+	for level := 0; ; level++ {
+		var in []int
+		for _, n := range nodes {
+			if overlaps(level, n, spans) {
+				in = append(in, n)
+			}
+		}
+		if len(in) == 0 {
+			return nil
+		}
+		da, err := hosts[a].Merkle(level, in, ks)
+		if err != nil {
+			return fmt.Errorf("%s : %s", hosts[a].Addr, err.Error())
+		}
+		db, err := hosts[b].Merkle(level, in, ks)
+		if err != nil {
+			return fmt.Errorf("%s : %s", hosts[b].Addr, err.Error())
+		}
+		var diff []int
+		for i, n := range in {
+			if da[i] != db[i] {
+				diff = append(diff, n)
+			}
+		}
+		c.mlock.Lock()
+		r.Nodes += int64(len(in))
+		c.mlock.Unlock()
+		if level == MerkleDepth {
+			return c.repairLeaves(r, hosts, index, a, b, diff)
+		}
+		nodes = nodes[:0]
+		for _, n := range diff {
+			nodes = append(nodes, 2*n, 2*n+1)
+		}
+	}
+}
+
+// repairLeaves copies the newer version of the keys replicated by both a
+// and b which differ between them in cas unique or exptime, a tombstone is
+// copied as it is listed.
+func (c *Scheduler) repairLeaves(r *Repair, hosts []*Host, index []uint64, a, b int, leaves []int) error {
+	if len(leaves) == 0 {
+		return nil
+	}
+	ks := c.Keyspace()
+	ka, err := hosts[a].MerkleKeys(leaves, ks)
+	if err != nil {
+		return fmt.Errorf("%s : %s", hosts[a].Addr, err.Error())
+	}
+	kb, err := hosts[b].MerkleKeys(leaves, ks)
+	if err != nil {
+		return fmt.Errorf("%s : %s", hosts[b].Addr, err.Error())
+	}
+	c.mlock.Lock()
+	r.Leaves += int64(len(leaves))
+	c.mlock.Unlock()
+
+	var keys []string
+	for key := range ka {
+		keys = append(keys, key)
+	}
+	for key := range kb {
+		if _, ok := ka[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	var cnt, repaired, errs int64
+	for _, key := range keys {
+		if !ks.Has(key) {
+			// held by another ring on the same servers
+			continue
+		}
+		ids := c.lookup(c.hash([]byte(key)), index)
+		if !containInt(ids, a) || !containInt(ids, b) {
+			continue
+		}
+		ia, ib := ka[key], kb[key]
+		if ia != nil && ib != nil && ia.Cas == ib.Cas && ia.Exptime == ib.Exptime && ia.Deleted == ib.Deleted {
+			continue
+		}
+		cnt++
+		src, dst := hosts[a], hosts[b]
+		newer := ia
+		if !Newer(ia, ib) {
+			src, dst, newer = dst, src, ib
+		}
+		item := newer
+		if !newer.Deleted {
+			items, err := src.Fetch([]string{key})
+			if err != nil {
+				errs++
+				continue
+			}
+			if item = items[key]; item == nil {
+				// reclaimed since
+				continue
+			}
+		}
+		if ok, err := dst.Set(key, item, false); err != nil || !ok {
+			errs++
+		} else {
+			repaired++
+		}
+	}
+	c.mlock.Lock()
+	r.Keys += cnt
+	r.Repaired += repaired
+	r.Errors += errs
+	c.mlock.Unlock()
+	return nil
+}
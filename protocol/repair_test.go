@@ -0,0 +1,144 @@
+package protocol
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// merkleStore computes its Merkle tree from all keys on every request.
+type merkleStore struct {
+	*mapStore
+	hash      HashMethod
+	reclaimed *uint64
+}
+
+func (s merkleStore) Reclaim(cas uint64, ks Keyspace) {
+	atomic.StoreUint64(s.reclaimed, cas)
+}
+
+func (s merkleStore) digests(level int, ks Keyspace) map[int]uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ds := make(map[int]uint64)
+	for key, item := range s.data {
+		if !ks.Has(key) {
+			continue
+		}
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s %d %d", key, item.Cas, item.Exptime)
+		ds[int(s.hash([]byte(key))>>uint(32-level))] ^= h.Sum64()
+	}
+	return ds
+}
+
+func (s merkleStore) Merkle(level int, nodes []int, ks Keyspace) ([]uint64, error) {
+	all := s.digests(level, ks)
+	ds := make([]uint64, len(nodes))
+	for i, n := range nodes {
+		ds[i] = all[n]
+	}
+	return ds, nil
+}
+
+func (s merkleStore) MerkleKeys(leaves []int, ks Keyspace) (map[string]*Item, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rs := make(map[string]*Item)
+	for key, item := range s.data {
+		leaf := int(s.hash([]byte(key)) >> (32 - MerkleDepth))
+		if containInt(leaves, leaf) && ks.Has(key) {
+			rs[key] = &Item{Cas: item.Cas, Exptime: item.Exptime, Deleted: item.Deleted}
+		}
+	}
+	return rs, nil
+}
+
+func TestRepair(t *testing.T) {
+	addrs := make([]string, 3)
+	reclaimed := make([]uint64, len(addrs))
+	for i := range addrs {
+		addrs[i] = startServer(t, merkleStore{NewMapStore(), HashMethods["crc32"], &reclaimed[i]})
+	}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 2, VNodes: 4})
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		hosts := sch.GetHostsByKey(key)
+		item := &Item{Body: []byte("old"), Cas: 1, Exptime: 2000000000}
+		for j, h := range hosts {
+			switch {
+			case i%10 == 1 && j == 1:
+				continue // lost copy
+			case i%10 == 2 && j == 0:
+				h.Set(key, &Item{Body: []byte("new"), Cas: 2}, false)
+			case i%10 == 3 && j == 1:
+				h.Set(key, &Item{Cas: 2, Deleted: true}, false)
+			case i%10 == 4 && j == 1:
+				h.Set(key, &Item{Body: []byte("old"), Cas: 1}, false) // lost exptime
+			default:
+				h.Set(key, item, false)
+			}
+		}
+	}
+
+	start := NewCas()
+	if err := sch.StartRepair(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && sch.Repair().State == "RUNNING"; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	r := sch.Repair()
+	if r.State != "DONE" || r.Keys != 40 || r.Repaired != 40 || r.Errors != 0 {
+		t.Errorf("bad repair %+v", r)
+	}
+	for i := range addrs {
+		if cas := atomic.LoadUint64(&reclaimed[i]); cas <= start || cas > NewCas() {
+			t.Errorf("%s reclaims before %d, repair started after %d", addrs[i], cas, start)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		expect := "old"
+		if i%10 == 2 {
+			expect = "new"
+		}
+		for _, h := range sch.GetHostsByKey(key) {
+			items, _ := h.Fetch([]string{key})
+			item := items[key]
+			if i%10 == 3 {
+				if item == nil || !item.Deleted {
+					t.Errorf("deleted %s on %s: %v", key, h.Addr, item)
+				}
+			} else if item == nil || string(item.Body) != expect || i%10 != 2 && item.Exptime != 2000000000 {
+				t.Errorf("%s on %s: %v", key, h.Addr, item)
+			}
+		}
+	}
+}
+
+func TestSharedRanges(t *testing.T) {
+	sch := NewScheduler([]string{"host1:7901", "host2:7901", "host3:7901"},
+		RingOptions{Replicas: 2, VNodes: 10})
+	pairs := sch.sharedRanges(sch.index)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		h := uint64(sch.hash([]byte(key)))
+		ids := sch.getHostIndex(key, sch.index)
+		if ids[0] > ids[1] {
+			ids[0], ids[1] = ids[1], ids[0]
+		}
+		found := false
+		for _, s := range pairs[[2]int{ids[0], ids[1]}] {
+			if s.lo <= h && h <= s.hi {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s is not in the ranges of %v", key, ids)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// a page of scan is picked out of all keys of a server
+var ScanTimeout time.Duration = time.Minute
+
+// Scan returns a page of the keys of host, see Scanner.
+func (host *Host) Scan(cursor, prefix string, limit int) ([]string, string, error) {
+	keys := []string{EncodeCursor(cursor), strconv.Itoa(limit)}
+	if prefix != "" {
+		keys = append(keys, prefix)
+	}
+	req := &Request{Cmd: "scan", Keys: keys}
+	resp, err := host.executeWithTimeout(req, ScanTimeout)
+	if err == nil {
+		err = resp.err()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := DecodeCursor(resp.msg)
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.keys, next, nil
+}
+
+// Scan merges the pages of the servers of the ring, the servers which are
+// down are left to their replicas. A key is listed once, if one of its
+// replicas has it: the copies left on other servers by a migration are
+// skipped. While migrating the servers of both rings are scanned, and the
+// replicas of a key are the ones its writes go to. A page may have less
+// than limit keys before the last one.
+func (c *Client) Scan(cursor, prefix string, limit int) ([]string, string, error) {
+	if limit < 1 {
+		return nil, "", errors.New("invalid limit")
+	}
+	c.sch.RLock()
+	hosts := c.sch.allHosts()
+	c.sch.RUnlock()
+
+	type result struct {
+		host *Host
+		keys []string
+		next string
+		err  error
+	}
+	rs := make(chan result, len(hosts))
+	n := 0
+	for _, h := range hosts {
+		if h.State() == HostDown {
+			continue
+		}
+		n++
+		go func(h *Host) {
+			keys, next, err := h.Scan(cursor, prefix, limit)
+			rs <- result{h, keys, next, err}
+		}(h)
+	}
+
+	// the keys after the end of the shortest page may be missing from the
+	// pages of the other servers
+	end := ""
+	found := make(map[string][]*Host)
+	var err error
+	for i := 0; i < n; i++ {
+		r := <-rs
+		if r.err != nil {
+			err = fmt.Errorf("%s : %s", r.host.Addr, r.err.Error())
+			continue
+		}
+		if r.next != "" && (end == "" || r.next < end) {
+			end = r.next
+		}
+		for _, key := range r.keys {
+			found[key] = append(found[key], r.host)
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	page := NewScanPage(cursor, prefix, limit)
+	for key, hs := range found {
+		if end != "" && key > end {
+			continue
+		}
+		owners := c.sch.GetWriteHostsByKey(key)
+		for _, h := range hs {
+			if containHost(owners, h) {
+				page.Add(key)
+				break
+			}
+		}
+	}
+	keys, next := page.Result()
+	if next == "" {
+		next = end
+	}
+	return keys, next, nil
+}
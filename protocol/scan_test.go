@@ -0,0 +1,108 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestScanPage(t *testing.T) {
+	page := NewScanPage("b", "k", 2)
+	for _, key := range []string{"k3", "a", "k1", "k4", "b", "k2"} {
+		page.Add(key)
+	}
+	if keys, next := page.Result(); fmt.Sprint(keys) != "[k1 k2]" || next != "k2" {
+		t.Errorf("got %v %q", keys, next)
+	}
+	page = NewScanPage("k2", "k", 2)
+	page.Add("k3")
+	if keys, next := page.Result(); fmt.Sprint(keys) != "[k3]" || next != "" {
+		t.Errorf("got %v %q", keys, next)
+	}
+}
+
+func TestClientScan(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, NewMapStore()))
+	}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 2, VNodes: 4})
+	client := NewClient(sch)
+
+	var expect []string
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		for _, h := range sch.GetHostsByKey(key) {
+			h.Set(key, &Item{Body: []byte("v")}, false)
+		}
+		expect = append(expect, key)
+	}
+	// a copy left on a server which does not own the key
+	for _, h := range sch.hosts {
+		if !containHost(sch.GetHostsByKey("key00stale"), h) {
+			h.Set("key00stale", &Item{Body: []byte("v")}, false)
+			break
+		}
+	}
+	for _, h := range sch.hosts {
+		h.Set("other", &Item{Body: []byte("v")}, false)
+	}
+
+	var keys []string
+	cursor := ""
+	for i := 0; i < 20; i++ {
+		page, next, e := client.Scan(cursor, "key", 7)
+		if e != nil || len(page) > 7 {
+			t.Fatalf("Scan got %v %q %v", page, next, e)
+		}
+		keys = append(keys, page...)
+		if cursor = next; cursor == "" {
+			break
+		}
+	}
+	if !sort.StringsAreSorted(keys) || fmt.Sprint(keys) != fmt.Sprint(expect) {
+		t.Errorf("Scan got %v", keys)
+	}
+}
+
+func TestClientScanMigrating(t *testing.T) {
+	retries, interval := MigrateRetries, MigratePollInterval
+	MigrateRetries, MigratePollInterval = 0, time.Millisecond
+	defer func() { MigrateRetries, MigratePollInterval = retries, interval }()
+
+	release := make(chan bool)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		addrs = append(addrs, startServer(t, stuckSource{replicaStore{NewMapStore()}, release}))
+	}
+	sch := NewScheduler(addrs[:2], RingOptions{Replicas: 1, VNodes: 10})
+	client := NewClient(sch)
+	if err := sch.Update(addrs); err != nil {
+		t.Fatal(err)
+	}
+
+	// keys written to the new server only, and to the old ring only
+	var expect []string
+	moved, kept := 0, 0
+	for i := 0; (moved < 3 || kept < 3) && i < 1000; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if hs := sch.GetHostsByKey2(key); hs[0].Addr == addrs[2] && moved < 3 {
+			hs[0].Set(key, &Item{Body: []byte("v")}, false)
+			expect = append(expect, key)
+			moved++
+		} else if hs[0].Addr != addrs[2] && kept < 3 {
+			sch.GetHostsByKey(key)[0].Set(key, &Item{Body: []byte("v")}, false)
+			expect = append(expect, key)
+			kept++
+		}
+	}
+	keys, next, err := client.Scan("", "key", 10)
+	if err != nil || next != "" || fmt.Sprint(keys) != fmt.Sprint(expect) {
+		t.Errorf("Scan while migrating got %v %q %v, expect %v", keys, next, err, expect)
+	}
+	close(release)
+	for i := 0; i < 100 && sch.Migrating(); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+}
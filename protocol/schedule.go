@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"sort"
 	"sync"
@@ -20,6 +22,13 @@ func (l uint64Slice) Swap(i, j int) {
 	l[i], l[j] = l[j], l[i]
 }
 
+type RingOptions struct {
+	Replicas int            // copies of every key
+	VNodes   int            // points on the ring of a server with weight 1
+	Weights  map[string]int // servers not listed have weight 1
+	Hash     string         // name in HashMethods, crc32 by default
+}
+
 type Scheduler struct {
 	sync.RWMutex
 	hosts, hosts2 []*Host
@@ -27,44 +36,116 @@ type Scheduler struct {
 	liveChan      string
 	deadChan      string
 	IsMegrating   bool
+	driving       bool // the migration is run by this scheduler
+	opts          RingOptions
+	hash          HashMethod
+	mlock         sync.Mutex // protects the fields below
+	migration     *Migration // the last one
+	migrations    int
+	repair        *Repair // the last one
+	repairs       int
+	prefixDelete  *PrefixDelete // the last one
+	prefixDeletes int
+	events        []*HostEvent // state changes of the servers
+	epoch         int64        // of the ring below, see SetEpoch
+	epochRing     []string
+	epochTarget   []string
+	retired       []*Host // left the ring, until they got its epoch
+	keyspace      Keyspace
 }
 
-func NewScheduler(hosts []string) *Scheduler {
+func NewScheduler(hosts []string, opts RingOptions) *Scheduler {
 	var c Scheduler
+	if opts.VNodes < 1 {
+		opts.VNodes = 1
+	}
+	if opts.Hash == "" {
+		opts.Hash = "crc32"
+	}
+	c.opts = opts
+	c.hash = HashMethods[opts.Hash]
+	if c.hash == nil {
+		panic("unknown hash method: " + opts.Hash)
+	}
 	c.hosts = make([]*Host, len(hosts))
-	c.index = make([]uint64, len(hosts))
 	for i, h := range hosts {
 		c.hosts[i] = NewHost(h)
-		v := crc32hash([]byte(h))
-		c.index[i] = (uint64(v) << 32) + uint64(i)
-	}
-	sort.Sort(uint64Slice(c.index))
-	if !sort.IsSorted(uint64Slice(c.index)) {
-		panic("sort failed")
 	}
+	c.index = c.buildIndex(hosts)
 	c.IsMegrating = false
 	return &c
 }
 
-func (c *Scheduler) getHostIndex(key string, index []uint64) []int {
-	h := uint64(crc32hash([]byte(key))) << 32
-	N := len(index)
-	i := sort.Search(N, func(k int) bool { return index[k] >= h })
-	if i == N {
-		i = 0
+func (c *Scheduler) weight(addr string) int {
+	if w, ok := c.opts.Weights[addr]; ok {
+		return w
+	}
+	return 1
+}
+
+// points returns the positions of the virtual nodes of a server, the first
+// one is the hash of its address.
+func (c *Scheduler) points(addr string) []uint32 {
+	ps := make([]uint32, c.opts.VNodes*c.weight(addr))
+	for j := range ps {
+		if j == 0 {
+			ps[j] = c.hash([]byte(addr))
+		} else {
+			ps[j] = c.hash([]byte(fmt.Sprintf("%s-%d", addr, j)))
+		}
+	}
+	return ps
+}
+
+// buildIndex puts the virtual nodes of all servers on the ring, every entry
+// is the position in the high 32 bits and the server id in the low ones.
+func (c *Scheduler) buildIndex(addrs []string) []uint64 {
+	index := make([]uint64, 0, len(addrs)*c.opts.VNodes)
+	for i, h := range addrs {
+		for _, v := range c.points(h) {
+			index = append(index, (uint64(v)<<32)+uint64(i))
+		}
 	}
-	id := int(index[i] & 0xffffffff)
-	if N >= 2 {
-		return []int{id, (id + 1) % N}
+	sort.Sort(uint64Slice(index))
+	return index
+}
+
+// Shares returns the fraction of the ring every server is the primary for.
+func (c *Scheduler) Shares() map[string]float64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	r := make(map[string]float64, len(c.hosts))
+	N := len(c.index)
+	for i, v := range c.index {
+		size := uint32(v>>32) - uint32(c.index[(i-1+N)%N]>>32)
+		if N == 1 {
+			size = 1<<32 - 1
+		}
+		r[c.hosts[v&0xffffffff].Addr] += float64(size) / (1 << 32)
+	}
+	return r
+}
+
+func (c *Scheduler) getHostIndex(key string, index []uint64) []int {
+	return c.lookup(c.hash([]byte(key)), index)
+}
+
+func containInt(vs []int, v int) bool {
+	for _, i := range vs {
+		if i == v {
+			return true
+		}
 	}
-	return []int{id}
+	return false
 }
 
+// GetHostsByKey returns the live replicas of key, see lookupLive.
 func (c *Scheduler) GetHostsByKey(key string) []*Host {
 	c.RLock()
 	defer c.RUnlock()
 
-	is := c.getHostIndex(key, c.index)
+	is := c.lookupLive(c.hash([]byte(key)), c.index, c.hosts)
 	r := make([]*Host, len(is))
 	for i, k := range is {
 		r[i] = c.hosts[k]
@@ -76,7 +157,7 @@ func (c *Scheduler) GetHostsByKey2(key string) []*Host {
 	c.RLock()
 	defer c.RUnlock()
 
-	is := c.getHostIndex(key, c.index2)
+	is := c.lookupLive(c.hash([]byte(key)), c.index2, c.hosts2)
 	r := make([]*Host, len(is))
 	for i, k := range is {
 		r[i] = c.hosts2[k]
@@ -84,67 +165,116 @@ func (c *Scheduler) GetHostsByKey2(key string) []*Host {
 	return r
 }
 
-//TODO Need to be Better !
+// GetWriteHostsByKey returns the live replicas of key writes go to. While
+// migrating they are the replicas of the new ring followed by the ones of
+// the old ring, which stays up to date in case the migration is aborted.
+func (c *Scheduler) GetWriteHostsByKey(key string) []*Host {
+	c.RLock()
+	defer c.RUnlock()
+
+	h := c.hash([]byte(key))
+	var r []*Host
+	if c.IsMegrating {
+		for _, k := range c.lookupLive(h, c.index2, c.hosts2) {
+			r = append(r, c.hosts2[k])
+		}
+	}
+	for _, k := range c.lookupLive(h, c.index, c.hosts) {
+		if !containHost(r, c.hosts[k]) {
+			r = append(r, c.hosts[k])
+		}
+	}
+	return r
+}
+
+// Keyspace returns the keys held by the ring, all of them unless it was
+// set by a Router.
+func (c *Scheduler) Keyspace() Keyspace {
+	c.RLock()
+	defer c.RUnlock()
+	return c.keyspace
+}
+
+func (c *Scheduler) SetKeyspace(ks Keyspace) {
+	c.Lock()
+	defer c.Unlock()
+	c.keyspace = ks
+}
+
+// Migrating tells whether the ring is being migrated.
+func (c *Scheduler) Migrating() bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.IsMegrating
+}
+
+// Servers returns the addresses of the servers in the ring.
+func (c *Scheduler) Servers() []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	addrs := make([]string, len(c.hosts))
+	for i, h := range c.hosts {
+		addrs[i] = h.Addr
+	}
+	return addrs
+}
 
-func (c *Scheduler) Update(addrs []string) {
+// Update moves the ring to servers addrs: writes go to both rings at once,
+// and reads move to the new one once the data is copied to the new owners.
+// The old ring, which got the writes too, is kept if the copy fails.
+func (c *Scheduler) Update(addrs []string) error {
 	log.Println("Update")
-	if len(addrs) == len(c.hosts) {
-		return
+	c.Lock()
+	defer c.Unlock()
+	if c.IsMegrating {
+		return errors.New("migration in progress")
 	}
-	c.hosts2 = make([]*Host, len(addrs))
-	c.index2 = make([]uint64, len(addrs))
-	for i, h := range addrs {
-		c.hosts2[i] = NewHost(h)
-		v := crc32hash([]byte(h))
-		c.index2[i] = (uint64(v) << 32) + uint64(i)
+
+	old := make(map[string]*Host, len(c.hosts))
+	for _, h := range c.hosts {
+		old[h.Addr] = h
+	}
+	added, removed := 0, len(c.hosts)
+	hosts2 := make([]*Host, len(addrs))
+	for i, addr := range addrs {
+		if h, ok := old[addr]; ok {
+			hosts2[i] = h
+			removed--
+		} else {
+			hosts2[i] = NewHost(addr)
+			added++
+		}
+	}
+	if added == 0 && removed == 0 {
+		return nil
 	}
-	sort.Sort(uint64Slice(c.index2))
+	if len(addrs) < c.opts.Replicas {
+		return errors.New("less servers than replicas")
+	}
+
+	c.hosts2 = hosts2
+	c.index2 = c.buildIndex(addrs)
 	c.IsMegrating = true
+	c.driving = true
+	tasks := c.planMigration(c.hosts, c.index, c.hosts2, c.index2)
+	tasks = c.skipCopied(addrs, tasks)
+	m := c.newMigration(addrs, tasks)
 	go func() {
-		c.doMigrateJob()
+		err := c.runMigration(m, tasks)
 		c.Lock()
+		before := c.allHosts()
 		c.IsMegrating = false
-		c.index = c.index2
-		c.hosts = c.hosts2
+		c.driving = false
+		if err != nil {
+			log.Println("migration aborted, keep the old ring:", err)
+		} else {
+			c.index = c.index2
+			c.hosts = c.hosts2
+		}
+		c.retire(before)
 		c.Unlock()
+		c.finishMigration(m, err)
 	}()
+	return nil
 }
-
-func (c *Scheduler) doMigrateJob() {
-	//TODO need better solution!!
-	log.Println("doMigrateJob")
-	addr := c.hosts2[len(c.hosts2)-1].Addr
-	N := len(c.hosts)
-	v := uint64(crc32hash([]byte(addr)))<<32 + uint64(N)
-	i := sort.Search(N, func(k int) bool { return c.index[k] >= v })
-	hid := c.index[i] & 0xffffffff
-	err := c.hosts[hid].Migrate(addr, uint32(c.index[(i-2+N)%N]>>32), uint32(v>>32))
-	if err != nil {
-		c.doMigrateJob()
-	}
-}
-
-//// 1 2 3 U 5 6
-//func (c *Scheduler) deleleNode(addr string) {
-//	c.Lock()
-//	defer c.Unlock()
-//
-//	var k int
-//	for i, h := range c.hosts {
-//		if h.Addr == addr {
-//			k = i
-//			break
-//		}
-//	}
-//	c.hosts = append(c.hosts[0:k], c.hosts[k:]...)
-//
-//	v := uint64(fvn1a([]byte(addr)))<<32 + uint64(j)
-//	i := sort.Search(len(c.index), func(int k) bool { return c.index[k] >= v })
-//	N := len(c.index)
-//	if N > 2 {
-//		id := (i - 2 + N) % N
-//		c.hosts[id].Migrate(i, c.index[(id-1+N)%N]>>32, c.index[id]>>32)
-//	}
-//	c.index = append(c.index[0:i], c.index[i:]...)
-//}
-//
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSchedulerReplicas(t *testing.T) {
+	addrs := []string{"host1:7901", "host2:7901", "host3:7901", "host4:7901"}
+	for i, replicas := range []int{1, 3, 4, 2} {
+		hash := []string{"crc32", "md5", "fnv1a", "fnv1a1"}[i]
+		sch := NewScheduler(addrs, RingOptions{Replicas: replicas, VNodes: 10, Hash: hash})
+		for i := 0; i < 100; i++ {
+			hosts := sch.GetHostsByKey(fmt.Sprintf("key%d", i))
+			if len(hosts) != replicas {
+				t.Fatalf("expect %d hosts, but got %d", replicas, len(hosts))
+			}
+			seen := make(map[*Host]bool)
+			for _, h := range hosts {
+				if seen[h] {
+					t.Fatalf("duplicated host %s", h.Addr)
+				}
+				seen[h] = true
+			}
+		}
+	}
+}
+
+func TestSchedulerShares(t *testing.T) {
+	addrs := []string{"host1:7901", "host2:7901", "host3:7901", "host4:7901"}
+	weights := map[string]int{"host4:7901": 2}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 2, VNodes: 100, Weights: weights})
+	shares := sch.Shares()
+	total := 0.0
+	for _, addr := range addrs {
+		expect := 0.2 * float64(sch.weight(addr))
+		if shares[addr] < expect*0.7 || shares[addr] > expect*1.3 {
+			t.Errorf("share of %s is %f, expect about %f", addr, shares[addr], expect)
+		}
+		total += shares[addr]
+	}
+	if total < 0.99 || total > 1.01 {
+		t.Errorf("total share is %f", total)
+	}
+}
+
+func TestSchedulerHealth(t *testing.T) {
+	// nothing listens on the last one
+	addrs := []string{startServer(t, NewMapStore()), startServer(t, NewMapStore()), freeAddr(t)}
+	sch := NewScheduler(addrs, RingOptions{Replicas: 2, VNodes: 10})
+
+	sch.CheckHealth()
+	if st := sch.HostStates(); st[addrs[0]] != "up" || st[addrs[2]] != "suspect" {
+		t.Errorf("states after one check: %v\n", st)
+	}
+	for i := 1; i < DownAfter; i++ {
+		sch.CheckHealth()
+	}
+	if st := sch.HostStates()[addrs[2]]; st != "down" {
+		t.Errorf("%s is %s, expect down\n", addrs[2], st)
+	}
+	es := sch.HostEvents()
+	if len(es) != 2 || es[0].To != "down" || es[1].From != "up" || es[1].To != "suspect" {
+		t.Errorf("events: %v\n", es)
+	}
+
+	moved := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%d", i)
+		hosts := sch.GetHostsByKey(key)
+		if len(hosts) != 2 || containHost(hosts, sch.hosts[2]) {
+			t.Fatalf("hosts of %s: %v\n", key, hosts)
+		}
+		if down := sch.GetDownHostsByKey(key); len(down) > 0 {
+			if down[0] != sch.hosts[2] {
+				t.Errorf("down hosts of %s: %v\n", key, down)
+			}
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Errorf("no key owned by %s\n", addrs[2])
+	}
+}